@@ -0,0 +1,117 @@
+package ocspstapling
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// maxIssuerSize limits the size of an issuer certificate downloaded from the AIA extension
+const maxIssuerSize = 1 << 20
+
+// defaultAIAConcurrency is the default number of concurrent issuer downloads, see WithAIAConcurrency
+const defaultAIAConcurrency = 4
+
+// aiaDownloads limits the concurrent issuer downloads of all Staplings without WithAIAConcurrency
+var aiaDownloads = make(chan struct{}, defaultAIAConcurrency)
+
+// aiaIssuers caches the issuer certificates downloaded from the CA Issuers URLs of the AIA extension of leaves
+type aiaIssuers struct {
+	lock sync.RWMutex
+	// issuers maps the CA Issuers URL to the downloaded issuer certificate
+	issuers map[string]*x509.Certificate
+}
+
+// lookup returns the cached issuer of the leaf, or nil
+func (a *aiaIssuers) lookup(leaf *x509.Certificate) *x509.Certificate {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	for _, url := range leaf.IssuingCertificateURL {
+		if issuer, ok := a.issuers[url]; ok {
+			return issuer
+		}
+	}
+	return nil
+}
+
+// forget drops the cached issuer of the leaf
+func (a *aiaIssuers) forget(leaf *x509.Certificate) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, url := range leaf.IssuingCertificateURL {
+		delete(a.issuers, url)
+	}
+}
+
+// download fetches the issuer of the leaf of certificate from the CA Issuers URLs of its AIA extension, unless the chain
+// already contains the issuer or it was downloaded before
+func (a *aiaIssuers) download(ctx context.Context, httpClient *http.Client, certificate tls.Certificate, cfg *config) error {
+	if len(certificate.Certificate) == 0 {
+		return ErrInvalidCertificate
+	}
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return ErrInvalidCertificate
+	}
+	if len(leaf.IssuingCertificateURL) == 0 || a.lookup(leaf) != nil {
+		return nil
+	}
+	for _, der := range certificate.Certificate[1:] {
+		if c, err := x509.ParseCertificate(der); err == nil && bytes.Equal(c.RawSubject, leaf.RawIssuer) {
+			// The chain is complete
+			return nil
+		}
+	}
+
+	for _, url := range leaf.IssuingCertificateURL {
+		issuer, err := downloadIssuer(ctx, httpClient, url, cfg)
+		if err != nil || leaf.CheckSignatureFrom(issuer) != nil {
+			continue
+		}
+		a.lock.Lock()
+		a.issuers[url] = issuer
+		a.lock.Unlock()
+		return nil
+	}
+	return ErrIssuerDownloadFailed
+}
+
+// downloadIssuer downloads a DER or PEM encoded certificate from url
+func downloadIssuer(ctx context.Context, httpClient *http.Client, url string, cfg *config) (*x509.Certificate, error) {
+	// Wait for a download slot, so many instances starting at once don't stampede the CA
+	select {
+	case cfg.aiaDownloads <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-cfg.aiaDownloads }()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Close = cfg.disableKeepAlive
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, ErrIssuerDownloadFailed
+	}
+	data, err := io.ReadAll(io.LimitReader(response.Body, maxIssuerSize))
+	if err != nil {
+		return nil, err
+	}
+
+	// RFC 5280 mandates DER, but some CAs serve PEM
+	if block, _ := pem.Decode(data); block != nil && block.Type == "CERTIFICATE" {
+		data = block.Bytes
+	}
+	return x509.ParseCertificate(data)
+}
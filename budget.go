@@ -0,0 +1,40 @@
+package ocspstapling
+
+import (
+	"sync"
+	"time"
+)
+
+// byteBudget limits the number of response bytes fetched per fixed window
+type byteBudget struct {
+	limit  uint64
+	window time.Duration
+
+	lock  sync.Mutex
+	start time.Time
+	used  uint64
+}
+
+// add accounts n fetched bytes to the current window
+func (b *byteBudget) add(n uint64, now time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.advance(now)
+	b.used += n
+}
+
+// exhausted reports whether the budget of the current window is used up, and when the next window starts
+func (b *byteBudget) exhausted(now time.Time) (bool, time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.advance(now)
+	return b.used >= b.limit, b.start.Add(b.window)
+}
+
+// advance starts a new window when the current one has passed. The caller must hold the lock.
+func (b *byteBudget) advance(now time.Time) {
+	if b.start.IsZero() || !now.Before(b.start.Add(b.window)) {
+		b.start = now
+		b.used = 0
+	}
+}
@@ -0,0 +1,62 @@
+package ocspstapling
+
+import (
+	"bytes"
+	"time"
+)
+
+// CertBundle is a transport format for a certificate and its staple, e.g. to hand them to other processes or nodes.
+// It doesn't contain the private key.
+type CertBundle struct {
+	// Leaf is the DER encoded leaf certificate
+	Leaf []byte
+	// Chain holds the DER encoded certificates following the leaf
+	Chain [][]byte
+	// Staple is the raw OCSP response, nil when there is no staple
+	Staple []byte
+	// ThisUpdate, NextUpdate and Status are taken from the staple
+	ThisUpdate time.Time
+	NextUpdate time.Time
+	// Status is one of ocsp.Good, ocsp.Revoked or ocsp.Unknown
+	Status int
+}
+
+// Bundle returns the certificate chain and the current staple with its metadata as a CertBundle
+func (s *Stapling) Bundle() CertBundle {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var bundle CertBundle
+	for i, der := range s.certificate.Certificate {
+		der = append([]byte(nil), der...)
+		if i == 0 {
+			bundle.Leaf = der
+			continue
+		}
+		bundle.Chain = append(bundle.Chain, der)
+	}
+	if len(s.certificate.OCSPStaple) > 0 {
+		bundle.Staple = append([]byte(nil), s.certificate.OCSPStaple...)
+		bundle.ThisUpdate = s.thisUpdate
+		bundle.NextUpdate = s.nextUpdate
+		bundle.Status = s.stapleStatus
+	}
+	return bundle
+}
+
+// LoadBundle installs the staple of a bundle created by Bundle, like SetStaple. The leaf of the bundle must be the leaf of
+// the internal certificate, otherwise ErrStapleKeyMismatch is returned. ErrNoValidStaple is returned when the bundle has no
+// staple.
+func (s *Stapling) LoadBundle(bundle CertBundle) error {
+	s.lock.RLock()
+	sameLeaf := len(s.certificate.Certificate) > 0 && bytes.Equal(s.certificate.Certificate[0], bundle.Leaf)
+	s.lock.RUnlock()
+
+	if !sameLeaf {
+		return ErrStapleKeyMismatch
+	}
+	if len(bundle.Staple) == 0 {
+		return ErrNoValidStaple
+	}
+	return s.SetStaple(bundle.Staple)
+}
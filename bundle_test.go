@@ -0,0 +1,81 @@
+package ocspstapling
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"golang.org/x/crypto/ocsp"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestBundleRoundTrip(t *testing.T) {
+	ca, certificate := newTestCertificate(t)
+	thisUpdate := time.Now().Add(-time.Minute).Truncate(time.Second)
+
+	for _, nextUpdate := range []time.Time{thisUpdate.Add(time.Hour), {}} {
+		source, err := NewStaplingE(context.Background(), certificate, WithTransport(ca.transport(t)))
+		if err != nil {
+			t.Fatalf("NewStaplingE() error = %v", err)
+		}
+		raw := ca.staple(t, 42, thisUpdate, nextUpdate)
+		if err := source.SetStaple(raw); err != nil {
+			t.Fatalf("SetStaple() error = %v", err)
+		}
+
+		bundle := source.Bundle()
+		if !bytes.Equal(bundle.Leaf, certificate.Certificate[0]) || len(bundle.Chain) != 1 ||
+			!bytes.Equal(bundle.Chain[0], certificate.Certificate[1]) {
+			t.Fatal("bundle doesn't hold the certificate chain")
+		}
+		if !bytes.Equal(bundle.Staple, raw) || !bundle.ThisUpdate.Equal(thisUpdate) ||
+			!bundle.NextUpdate.Equal(nextUpdate) || bundle.Status != ocsp.Good {
+			t.Fatalf("bundle = %+v, want the staple with ThisUpdate %v and NextUpdate %v", bundle, thisUpdate, nextUpdate)
+		}
+		// The bundle is a copy
+		bundle.Staple[0] ^= 0xff
+		if stapled := source.Bundle(); !bytes.Equal(stapled.Staple, raw) {
+			t.Fatal("modifying the bundle changed the staple")
+		}
+		bundle.Staple[0] ^= 0xff
+
+		target, err := NewStaplingE(context.Background(), certificate, WithTransport(ca.transport(t)))
+		if err != nil {
+			t.Fatalf("NewStaplingE() error = %v", err)
+		}
+		if err := target.LoadBundle(bundle); err != nil {
+			t.Fatalf("LoadBundle() with NextUpdate %v error = %v", nextUpdate, err)
+		}
+		if loaded := target.Bundle(); !bytes.Equal(loaded.Staple, raw) || target.StapleSource() != SourceImported {
+			t.Fatal("LoadBundle() didn't install the staple")
+		}
+	}
+}
+
+func TestLoadBundleErrors(t *testing.T) {
+	ca, certificate := newTestCertificate(t)
+	s, err := NewStaplingE(context.Background(), certificate, WithTransport(ca.transport(t)))
+	if err != nil {
+		t.Fatalf("NewStaplingE() error = %v", err)
+	}
+	other := ca.certificate(t, x509.Certificate{SerialNumber: big.NewInt(43)})
+
+	tests := []struct {
+		name    string
+		bundle  CertBundle
+		wantErr error
+	}{
+		{"other leaf", CertBundle{Leaf: other.Certificate[0], Staple: ca.staple(t, 43, time.Now(), time.Time{})}, ErrStapleKeyMismatch},
+		{"without staple", CertBundle{Leaf: certificate.Certificate[0]}, ErrNoValidStaple},
+		{"staple of other leaf", CertBundle{Leaf: certificate.Certificate[0], Staple: ca.staple(t, 43, time.Now(), time.Time{})}, ErrStapleKeyMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := s.LoadBundle(tt.bundle); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("LoadBundle() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
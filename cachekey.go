@@ -0,0 +1,37 @@
+package ocspstapling
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+)
+
+// CacheKey returns the key identifying the OCSP response of the certificate in caches, e.g. an OCSPStore shared between
+// hosts. The key is the lowercase hex SHA-256 hash of the issuer's public key and the lowercase hex serial number of the
+// leaf, separated by a colon. Like the CertID of an OCSP request it only depends on the issuer key and the serial number,
+// so it is the same for every host serving the certificate, regardless of the order of the chain. The format is stable
+// across restarts and versions of this package.
+func CacheKey(certificate tls.Certificate) (string, error) {
+	cfg := newConfig(nil)
+	return cacheKey(certificate, &cfg)
+}
+
+// cacheKey returns the CacheKey of the certificate, using cfg to find the leaf and issuer in the chain
+func cacheKey(certificate tls.Certificate, cfg *config) (string, error) {
+	x509Cert, x509Issuer, err := parseChain(certificate, cfg)
+	if err != nil {
+		return "", err
+	}
+
+	var publicKeyInfo struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(x509Issuer.RawSubjectPublicKeyInfo, &publicKeyInfo); err != nil {
+		return "", ErrInvalidCertificate
+	}
+	issuerKeyHash := sha256.Sum256(publicKeyInfo.PublicKey.RightAlign())
+	return hex.EncodeToString(issuerKeyHash[:]) + ":" + x509Cert.SerialNumber.Text(16), nil
+}
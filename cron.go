@@ -0,0 +1,150 @@
+package ocspstapling
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSearchLimit bounds the search for the next matching instant of a schedule, e.g. for "0 0 30 2 *" which never matches
+const cronSearchLimit = 5 * 366 * 24 * time.Hour
+
+// cronSchedule is a parsed standard 5 field cron specification: minute hour day-of-month month day-of-week.
+// Each field supports '*', numbers, ranges (1-5), lists (1,15) and steps (*/15, 0-30/10).
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// domStar and dowStar are set when the day fields are '*'. If both day fields are restricted, a day matches when either
+	// field matches, like in standard cron.
+	domStar, dowStar bool
+}
+
+// parseCron parses a 5 field cron specification
+func parseCron(spec string) (*cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron spec %q: expected 5 fields, got %d", spec, len(fields))
+	}
+
+	var schedule cronSchedule
+	var err error
+	if schedule.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("cron spec %q: minute: %w", spec, err)
+	}
+	if schedule.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("cron spec %q: hour: %w", spec, err)
+	}
+	if schedule.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("cron spec %q: day of month: %w", spec, err)
+	}
+	if schedule.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("cron spec %q: month: %w", spec, err)
+	}
+	// Both 0 and 7 are Sunday
+	if schedule.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("cron spec %q: day of week: %w", spec, err)
+	}
+	if schedule.dow&(1<<7) != 0 {
+		schedule.dow |= 1
+	}
+	schedule.domStar = fields[2] == "*"
+	schedule.dowStar = fields[4] == "*"
+
+	return &schedule, nil
+}
+
+// parseCronField parses a single cron field into a bit set of the allowed values
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			var err error
+			rangePart = part[:i]
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+		}
+
+		low, high := min, max
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if low, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value in %q", part)
+			}
+			high = low
+			if len(bounds) == 2 {
+				if high, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid value in %q", part)
+				}
+			} else if step != 1 {
+				// "5/15" means every 15 starting at 5
+				high = max
+			}
+		}
+		if low < min || high > max || low > high {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+
+		for v := low; v <= high; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// next returns the first instant matching the schedule strictly after t, in the location of t. The zero time is returned
+// when the schedule doesn't match within the search limit.
+func (c *cronSchedule) next(t time.Time) time.Time {
+	limit := t.Add(cronSearchLimit)
+	t = t.Truncate(time.Minute).Add(time.Minute)
+
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = advance(t, time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location()))
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = advance(t, time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location()))
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = nextHour(t)
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// advance returns u when it is after t and otherwise the start of the hour after t. time.Date normalizes a wall clock
+// time skipped by a DST transition to an instant that can lie before t, e.g. midnight in a zone that springs forward at
+// 24:00.
+func advance(t, u time.Time) time.Time {
+	if u.After(t) {
+		return u
+	}
+	return nextHour(t)
+}
+
+// nextHour returns the start of the hour after t. It advances in absolute time, because time.Date(..., t.Hour()+1, ...)
+// maps 02:00 on a spring forward in America/New_York back to 01:00 EST.
+func nextHour(t time.Time) time.Time {
+	return t.Add(time.Duration(60-t.Minute()) * time.Minute)
+}
+
+// dayMatches reports whether the day of t matches the day-of-month and day-of-week fields
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	domMatch := c.dom&(1<<uint(t.Day())) != 0
+	dowMatch := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
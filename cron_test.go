@@ -0,0 +1,98 @@
+package ocspstapling
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	load := func(name string) *time.Location {
+		location, err := time.LoadLocation(name)
+		if err != nil {
+			t.Skipf("time zone %s not available: %v", name, err)
+		}
+		return location
+	}
+	newYork := load("America/New_York")
+	santiago := load("America/Santiago")
+
+	tests := []struct {
+		name string
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		{
+			name: "spring forward",
+			spec: "0 3 * * *",
+			from: time.Date(2026, time.March, 7, 12, 0, 0, 0, newYork),
+			want: time.Date(2026, time.March, 8, 3, 0, 0, 0, newYork),
+		},
+		{
+			name: "skipped wall clock time",
+			spec: "30 2 * * *",
+			from: time.Date(2026, time.March, 7, 12, 0, 0, 0, newYork),
+			want: time.Date(2026, time.March, 9, 2, 30, 0, 0, newYork),
+		},
+		{
+			name: "fall back",
+			spec: "0 3 * * *",
+			from: time.Date(2026, time.October, 31, 12, 0, 0, 0, newYork),
+			want: time.Date(2026, time.November, 1, 3, 0, 0, 0, newYork),
+		},
+		{
+			name: "repeated wall clock time",
+			spec: "30 1 * * *",
+			from: time.Date(2026, time.October, 31, 12, 0, 0, 0, newYork),
+			want: time.Date(2026, time.November, 1, 1, 30, 0, 0, newYork),
+		},
+		{
+			name: "midnight skipped by spring forward",
+			spec: "0 12 * * 0",
+			from: time.Date(2026, time.September, 5, 23, 30, 0, 0, santiago),
+			want: time.Date(2026, time.September, 6, 12, 0, 0, 0, santiago),
+		},
+		{
+			name: "never matches",
+			spec: "0 0 30 2 *",
+			from: time.Date(2026, time.October, 15, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			// Thursday the 15th, the 13th has passed but Friday matches the day of week
+			name: "day of month or day of week",
+			spec: "0 0 13 * 5",
+			from: time.Date(2026, time.October, 15, 0, 0, 0, 0, time.UTC),
+			want: time.Date(2026, time.October, 16, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			// Thursday the 15th, the 16th matches the day of month before the next Monday
+			name: "day of week or day of month",
+			spec: "0 0 16 * 1",
+			from: time.Date(2026, time.October, 15, 0, 0, 0, 0, time.UTC),
+			want: time.Date(2026, time.October, 16, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "day of week only",
+			spec: "0 0 * * 1",
+			from: time.Date(2026, time.October, 15, 0, 0, 0, 0, time.UTC),
+			want: time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "day of month only",
+			spec: "0 0 13 * *",
+			from: time.Date(2026, time.October, 15, 0, 0, 0, 0, time.UTC),
+			want: time.Date(2026, time.November, 13, 0, 0, 0, 0, time.UTC),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule, err := parseCron(tt.spec)
+			if err != nil {
+				t.Fatalf("parseCron(%q) error = %v", tt.spec, err)
+			}
+			if got := schedule.next(tt.from); !got.Equal(tt.want) {
+				t.Errorf("next(%v) = %v, want %v", tt.from, got, tt.want)
+			}
+		})
+	}
+}
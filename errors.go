@@ -1,13 +1,102 @@
 package ocspstapling
 
-import "errors"
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
 
 var (
-	ErrInvalidCertificate        = errors.New("invalid certificate provided")
-	ErrNoOCSPServerDefined       = errors.New("no OCSP Server defined")
-	ErrCouldNotCreateOCSPRequest = errors.New("could not create OCSP request")
-	ErrCouldNotPostOCSPRequest   = errors.New("could not post OCSP request")
-	ErrCouldNotReadOCSPResponse  = errors.New("could not read OCSP response")
-	ErrCouldNotCloseBody         = errors.New("could not close response body")
-	ErrCouldNotParseResponse     = errors.New("response is not a valid ocsp response")
+	ErrInvalidCertificate          = errors.New("invalid certificate provided")
+	ErrNoOCSPServerDefined         = errors.New("no OCSP Server defined")
+	ErrCouldNotCreateOCSPRequest   = errors.New("could not create OCSP request")
+	ErrCouldNotPostOCSPRequest     = errors.New("could not post OCSP request")
+	ErrCouldNotReadOCSPResponse    = errors.New("could not read OCSP response")
+	ErrCouldNotCloseBody           = errors.New("could not close response body")
+	ErrCouldNotParseResponse       = errors.New("response is not a valid ocsp response")
+	ErrNoValidStaple               = errors.New("no valid OCSP staple available")
+	ErrResponseExpired             = errors.New("OCSP response has expired")
+	ErrInvalidResponderCertificate = errors.New("OCSP responder certificate is not authorized by the issuer")
+	ErrRequestSigningFailed        = errors.New("could not sign OCSP request")
+	ErrIssuerMismatch              = errors.New("issuer certificate did not sign the certificate")
+	ErrUnexpectedContentType       = errors.New("OCSP response has an unexpected content type")
+	ErrWeakResponseSignature       = errors.New("OCSP response is signed with a disallowed signature algorithm")
+	ErrMissingIssuer               = errors.New("no issuer certificate available, include the intermediate in the chain")
+	ErrEmptyResponse               = errors.New("OCSP responder returned an empty response")
+	ErrCertificateNotTimeValid     = errors.New("certificate is not yet valid or has expired")
+	ErrMissingNextUpdate           = errors.New("OCSP response has no NextUpdate")
+	ErrStapleKeyMismatch           = errors.New("OCSP staple is for a different certificate than the served certificate")
+	ErrResponderNotAllowed         = errors.New("no OCSP responder is on the allowlist")
+	ErrCertificateRevoked          = errors.New("certificate has been revoked")
+	ErrCertificateStatusUnknown    = errors.New("OCSP responder doesn't know the certificate")
+	ErrOCSPResponseExpired         = errors.New("fetched OCSP response is expired or not yet valid")
+	ErrStaleResponse               = errors.New("fetched OCSP response is older than the current staple")
+	ErrByteBudgetExceeded          = errors.New("byte budget for fetching OCSP responses is exhausted")
+	ErrOCSPNonceMismatch           = errors.New("OCSP response doesn't echo the nonce of the request")
+	ErrAmbiguousLeaf               = errors.New("certificate chain contains multiple end-entity certificates")
+	ErrNoCertificate               = errors.New("no certificate added to the manager")
+	ErrSelfTestFailed              = errors.New("OCSP staple was not delivered in the self-test handshake")
+	ErrOCSPSerialMismatch          = errors.New("OCSP response is for a different serial number than the certificate")
+	ErrIssuerDownloadFailed        = errors.New("could not download the issuer certificate from the AIA extension")
+	ErrIssuerNotFound              = errors.New("none of the certificates named as issuer signed the certificate")
+	ErrUnexpectedHTTPStatus        = errors.New("OCSP responder returned an unexpected HTTP status")
+	ErrMissingSCT                  = errors.New("certificate has no embedded signed certificate timestamps")
+	ErrInvalidOption               = errors.New("invalid option")
+	ErrNoMatchingKey               = errors.New("no private key matches the certificate")
+	ErrCacheTampered               = errors.New("stored OCSP staple doesn't match its signature")
 )
+
+// FetchAttempt describes a single request made to an OCSP responder and its outcome
+type FetchAttempt struct {
+	Responder string
+	Hash      crypto.Hash
+	Method    string
+	Err       error
+}
+
+// HTTPStatusError is returned when an OCSP responder answers with another HTTP status than 200 OK. errors.Is reports it as
+// ErrUnexpectedHTTPStatus.
+type HTTPStatusError struct {
+	StatusCode int
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("%s: %d %s", ErrUnexpectedHTTPStatus, e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+func (e *HTTPStatusError) Is(target error) bool {
+	return target == ErrUnexpectedHTTPStatus
+}
+
+// temporary reports whether the status indicates an overloaded or unavailable responder, so the request may succeed later
+func (e *HTTPStatusError) temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+// FetchError is returned when every attempt to fetch an OCSP response failed. It summarizes all attempts,
+// errors.Is can be used to check for the errors of the individual attempts (e.g. ErrCouldNotPostOCSPRequest)
+type FetchError struct {
+	Attempts []FetchAttempt
+}
+
+func (e *FetchError) Error() string {
+	var b strings.Builder
+	b.WriteString("all OCSP fetch attempts failed: ")
+	for i, attempt := range e.Attempts {
+		if i > 0 {
+			b.WriteString("; ")
+		}
+		fmt.Fprintf(&b, "%s %s (%s): %v", attempt.Method, attempt.Responder, attempt.Hash, attempt.Err)
+	}
+	return b.String()
+}
+
+func (e *FetchError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Attempts))
+	for _, attempt := range e.Attempts {
+		errs = append(errs, attempt.Err)
+	}
+	return errs
+}
@@ -0,0 +1,144 @@
+package ocspstapling
+
+import (
+	"golang.org/x/crypto/ocsp"
+	"time"
+)
+
+// eventBufferSize is the capacity of the Events channel, events are dropped when the consumer falls this far behind
+const eventBufferSize = 64
+
+// EventType identifies the kind of lifecycle change an Event describes
+type EventType int
+
+const (
+	// EventFetchSucceeded is emitted when an OCSP response was fetched, NextUpdate is set
+	EventFetchSucceeded EventType = iota + 1
+	// EventFetchFailed is emitted when fetching an OCSP response failed, Err is set
+	EventFetchFailed
+	// EventStapleInstalled is emitted when a new staple is installed, NextUpdate is set
+	EventStapleInstalled
+	// EventStapleExpired is emitted when the renewal loop notices the installed staple passed its NextUpdate
+	EventStapleExpired
+	// EventStateChanged is emitted when the state of the renewal loop changes, State is set
+	EventStateChanged
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventFetchSucceeded:
+		return "fetch succeeded"
+	case EventFetchFailed:
+		return "fetch failed"
+	case EventStapleInstalled:
+		return "staple installed"
+	case EventStapleExpired:
+		return "staple expired"
+	case EventStateChanged:
+		return "state changed"
+	default:
+		return "unknown event"
+	}
+}
+
+// State is the state of the renewal loop
+type State int
+
+const (
+	// StateActive means the renewal loop renews the staple
+	StateActive State = iota + 1
+	// StatePaused means the renewal loop was paused with Pause
+	StatePaused
+	// StateDisabled means stapling was disabled after a fatal error
+	StateDisabled
+	// StateStopped means the renewal loop returned
+	StateStopped
+)
+
+func (s State) String() string {
+	switch s {
+	case StateActive:
+		return "active"
+	case StatePaused:
+		return "paused"
+	case StateDisabled:
+		return "disabled"
+	case StateStopped:
+		return "stopped"
+	default:
+		return "unknown state"
+	}
+}
+
+// Event describes a lifecycle change of a Stapling. Type determines which of the other fields are set.
+type Event struct {
+	Type       EventType
+	Time       time.Time
+	Err        error
+	NextUpdate time.Time
+	State      State
+}
+
+// Events returns a channel on which all lifecycle changes are delivered in order. Events are sent without blocking, so
+// they are dropped when the channel's buffer is full. The channel is closed when RunOCSPRenewal returns or Close is called.
+func (s *Stapling) Events() <-chan Event {
+	return s.events
+}
+
+// emit sends the event without blocking
+func (s *Stapling) emit(event Event) {
+	event.Time = time.Now()
+
+	s.eventsLock.Lock()
+	defer s.eventsLock.Unlock()
+	if s.eventsClosed {
+		return
+	}
+	select {
+	case s.events <- event:
+	default:
+	}
+}
+
+// closeEvents closes the Events channel, later events are discarded
+func (s *Stapling) closeEvents() {
+	s.eventsLock.Lock()
+	defer s.eventsLock.Unlock()
+	if !s.eventsClosed {
+		s.eventsClosed = true
+		close(s.events)
+	}
+}
+
+// RenewalResult is the outcome of a fetch, passed to the callback configured with WithOnRenewal
+type RenewalResult struct {
+	// Time is when the fetch completed
+	Time time.Time
+	// Err is the error of the fetch, nil when it succeeded
+	Err error
+	// NextUpdate is the NextUpdate of the fetched response, zero when the fetch failed
+	NextUpdate time.Time
+	// Status is the certificate status of the fetched response (ocsp.Good, ocsp.Revoked or ocsp.Unknown), ocsp.Unknown when
+	// the fetch failed
+	Status int
+	// NextRenewal is when the renewal loop is scheduled to fetch next, zero when no renewal was scheduled yet
+	NextRenewal time.Time
+}
+
+// renewalResult describes the outcome of a fetch. The caller must hold the lock.
+func (s *Stapling) renewalResult(result *fetchResult, err error) RenewalResult {
+	renewal := RenewalResult{Time: time.Now(), Err: err, Status: ocsp.Unknown, NextRenewal: s.nextRenewal}
+	if result != nil {
+		renewal.NextUpdate = result.response.NextUpdate
+		renewal.Status = result.response.Status
+	}
+	return renewal
+}
+
+// notifyRenewal passes the outcome of a fetch to the OnRenewal callback. It must be called without holding the lock, so
+// the callback can call methods of the Stapling.
+func (s *Stapling) notifyRenewal(renewal RenewalResult) {
+	if s.config.onRenewal != nil {
+		s.config.onRenewal(renewal)
+	}
+}
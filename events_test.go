@@ -0,0 +1,47 @@
+package ocspstapling
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCloseClosesEventsWithoutRenewalLoop(t *testing.T) {
+	ca, certificate := newTestCertificate(t)
+	s, err := NewStaplingE(context.Background(), certificate, WithTransport(ca.transport(t)))
+	if err != nil {
+		t.Fatalf("NewStaplingE() error = %v", err)
+	}
+
+	done := make(chan []EventType)
+	go func() {
+		var types []EventType
+		for event := range s.Events() {
+			types = append(types, event.Type)
+		}
+		done <- types
+	}()
+	if err := s.RefreshNow(context.Background()); err != nil {
+		t.Fatalf("RefreshNow() error = %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	select {
+	case types := <-done:
+		installed := false
+		for _, typ := range types {
+			installed = installed || typ == EventStapleInstalled
+		}
+		if !installed {
+			t.Errorf("events = %v, want EventStapleInstalled", types)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Events() wasn't closed by Close()")
+	}
+	// Closing again and running the renewal loop afterwards must not close the channel twice
+	if err := s.Close(); err != nil {
+		t.Fatalf("second Close() error = %v", err)
+	}
+	s.RunOCSPRenewal(context.Background())
+}
@@ -0,0 +1,652 @@
+package ocspstapling
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"golang.org/x/crypto/ocsp"
+	"io"
+	"math/big"
+	"mime"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FetchInfo describes a successful fetch of an OCSP response
+type FetchInfo struct {
+	// Responder is the URL of the responder that returned the response
+	Responder string
+	// NetworkDuration is the time spent sending the request and reading the response
+	NetworkDuration time.Duration
+	// ParseDuration is the time spent parsing and verifying the response
+	ParseDuration time.Duration
+	// ResponderAddrs are the IP addresses the responder host resolved to, only recorded with WithHTTPTrace. It is empty when
+	// no DNS lookup was made, e.g. when a kept-alive connection was reused.
+	ResponderAddrs []string
+}
+
+// fetchResult is the outcome of a successful fetch of an OCSP response
+type fetchResult struct {
+	// raw is the DER encoded OCSP response, as stapled to the certificate
+	raw      []byte
+	response *ocsp.Response
+	info     FetchInfo
+	// cacheExpiry is when the HTTP response expires according to its Cache-Control max-age or Expires header, zero when
+	// neither is present. The renewal loop renews at the earlier of this and the time derived from the OCSP response.
+	cacheExpiry time.Time
+	// leaf is the DER encoded leaf the response was fetched for, set by Stapling.fetch
+	leaf []byte
+}
+
+// fetchRequest is an OCSP request for a certificate, as sent to every responder
+type fetchRequest struct {
+	// der is the DER encoded OCSP request
+	der []byte
+	// hash is the hash algorithm of the CertID
+	hash crypto.Hash
+	// nonce is the value of the nonce extension, nil when no nonce is sent
+	nonce []byte
+	// serial is the serial number of the certificate the request is for
+	serial *big.Int
+	// issuer is the issuer of the certificate, that signs the responses
+	issuer *x509.Certificate
+}
+
+// fetchOCSP uses the certificate and httpClient to get a raw response from the Certificate issuer. The requests are made
+// with ctx, so cancelling it aborts the fetch and its values are available to the HTTP client.
+// returns the raw and parsed response (for renewal) or an error in case something went wrong.
+// When every request to the responder(s) failed, the returned error is a *FetchError describing each attempt.
+func fetchOCSP(ctx context.Context, certificate tls.Certificate, httpClient *http.Client, cfg *config) (*fetchResult, error) {
+	if cfg.aiaIssuers != nil {
+		// Download the issuer when it is missing from the chain, parseChain picks it up from the cache
+		if err := cfg.aiaIssuers.download(ctx, httpClient, certificate, cfg); err != nil {
+			return nil, err
+		}
+	}
+	x509Cert, x509Issuer, err := parseChain(certificate, cfg)
+	if err != nil {
+		return nil, err
+	}
+	// Responders often answer unknown for certificates that aren't valid, so don't bother contacting them
+	if now := time.Now(); now.Before(x509Cert.NotBefore) || now.After(x509Cert.NotAfter) {
+		return nil, ErrCertificateNotTimeValid
+	}
+	if cfg.requireSCT && !hasEmbeddedSCTs(x509Cert) {
+		return nil, ErrMissingSCT
+	}
+	responders := cfg.responders(x509Cert, x509Issuer)
+	if len(responders) == 0 {
+		// If there are no OCSPServers defined in the certificate, just return the TLS certificate as is.
+		return nil, ErrNoOCSPServerDefined
+	}
+	responders = cfg.allowedResponders(responders)
+	if len(responders) == 0 {
+		return nil, ErrResponderNotAllowed
+	}
+	if cfg.byteBudget != nil {
+		if exhausted, _ := cfg.byteBudget.exhausted(time.Now()); exhausted {
+			return nil, ErrByteBudgetExceeded
+		}
+	}
+	// Create the OCSP request using the 'Owner certificate' and the 'Issuer certificate'
+	request := &fetchRequest{hash: cfg.requestHash, serial: x509Cert.SerialNumber, issuer: x509Issuer}
+	request.der, err = ocsp.CreateRequest(x509Cert, x509Issuer, &ocsp.RequestOptions{Hash: request.hash})
+	if err != nil {
+		return nil, ErrCouldNotCreateOCSPRequest
+	}
+	if cfg.requestNonce {
+		request.der, request.nonce, err = addNonce(request.der)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.requestSigner != nil {
+		request.der, err = signRequest(request.der, cfg.requestSigner, cfg.requestSignerCert)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.raceResponders {
+		return raceOCSP(ctx, httpClient, responders, request, cfg)
+	}
+
+	// Try the responders in order until one returns a valid response. (Let's Encrypt certificates usually only have 1 OCSPServer
+	attempts := make([]FetchAttempt, 0, len(responders))
+	for _, ocspServer := range responders {
+		result, err := postOCSP(ctx, httpClient, ocspServer, request, cfg)
+		attempt := FetchAttempt{Responder: ocspServer, Hash: request.hash, Method: http.MethodPost, Err: err}
+		cfg.logAttempt(attempt)
+		if err == nil {
+			// Return the ocsp response data
+			return result, nil
+		}
+		attempts = append(attempts, attempt)
+		if ctx.Err() != nil {
+			// Cancelled, the remaining responders would fail as well
+			break
+		}
+	}
+
+	return nil, &FetchError{Attempts: attempts}
+}
+
+// countFetchedBytes accounts n response bytes read from a responder
+func (cfg *config) countFetchedBytes(n int) {
+	cfg.bytesFetched.Add(uint64(n))
+	if cfg.byteBudget != nil {
+		cfg.byteBudget.add(uint64(n), time.Now())
+	}
+}
+
+// responders returns the URLs of the OCSP responders to contact for the certificate, after applying the URL rewriter.
+// When the certificate doesn't define any OCSP server, the responder configured for its issuer is used. A responder URL
+// configured with WithResponderURL replaces all of them.
+func (cfg *config) responders(x509Cert, x509Issuer *x509.Certificate) []string {
+	if cfg.responderURL != "" {
+		return []string{cfg.responderURL}
+	}
+	ocspServers := x509Cert.OCSPServer
+	if len(ocspServers) == 0 {
+		if responder, ok := cfg.responderForIssuer(x509Issuer); ok {
+			ocspServers = []string{responder}
+		}
+	}
+
+	responders := make([]string, 0, len(ocspServers))
+	for _, responder := range ocspServers {
+		if cfg.urlRewriter != nil {
+			responder = cfg.urlRewriter(responder)
+		}
+		responders = append(responders, responder)
+	}
+	return responders
+}
+
+// allowedResponders filters out the responders whose host is not on the allowlist. In report-only mode the responders are
+// logged and counted instead, and all responders are returned.
+func (cfg *config) allowedResponders(responders []string) []string {
+	if cfg.responderAllowlist == nil {
+		return responders
+	}
+
+	allowed := make([]string, 0, len(responders))
+	for _, responder := range responders {
+		u, err := url.Parse(responder)
+		if err == nil {
+			if _, ok := cfg.responderAllowlist[strings.ToLower(u.Hostname())]; ok {
+				allowed = append(allowed, responder)
+				continue
+			}
+		}
+
+		cfg.allowlistMisses.Add(1)
+		if cfg.allowlistReportOnly {
+			cfg.logger.Warn("ocspstapling: OCSP responder is not on the allowlist", "responder", responder)
+			allowed = append(allowed, responder)
+			continue
+		}
+		cfg.logger.Debug("ocspstapling: skipping OCSP responder that is not on the allowlist", "responder", responder)
+	}
+	return allowed
+}
+
+// responderForIssuer looks up the responder of the issuer by common name or hex encoded subject key identifier
+func (cfg *config) responderForIssuer(x509Issuer *x509.Certificate) (string, bool) {
+	if responder, ok := cfg.responderByIssuer[x509Issuer.Subject.CommonName]; ok {
+		return responder, true
+	}
+	if len(x509Issuer.SubjectKeyId) == 0 {
+		return "", false
+	}
+	responder, ok := cfg.responderByIssuer[hex.EncodeToString(x509Issuer.SubjectKeyId)]
+	return responder, ok
+}
+
+// raceOCSP POSTs the ocspRequest to all responders concurrently and returns the first valid response. The requests that are
+// still in flight once a winner is chosen are cancelled.
+func raceOCSP(ctx context.Context, httpClient *http.Client, responders []string, request *fetchRequest, cfg *config) (*fetchResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	// Cancels the losing requests
+	defer cancel()
+
+	type raceResult struct {
+		attempt FetchAttempt
+		result  *fetchResult
+	}
+	// Buffered, so the losing goroutines never block after a winner was chosen
+	results := make(chan raceResult, len(responders))
+	for _, responder := range responders {
+		go func(responder string) {
+			result, err := postOCSP(ctx, httpClient, responder, request, cfg)
+			results <- raceResult{
+				attempt: FetchAttempt{Responder: responder, Hash: request.hash, Method: http.MethodPost, Err: err},
+				result:  result,
+			}
+		}(responder)
+	}
+
+	attempts := make([]FetchAttempt, 0, len(responders))
+	for range responders {
+		r := <-results
+		cfg.logAttempt(r.attempt)
+		if r.attempt.Err == nil {
+			return r.result, nil
+		}
+		attempts = append(attempts, r.attempt)
+	}
+
+	return nil, &FetchError{Attempts: attempts}
+}
+
+// parseChain parses the 'Owner certificate' and the 'Issuer certificate' from the certificate chain
+func parseChain(certificate tls.Certificate, cfg *config) (*x509.Certificate, *x509.Certificate, error) {
+	// Owner Certificate should be index 0 in chain
+	if len(certificate.Certificate) == 0 {
+		return nil, nil, ErrInvalidCertificate
+	}
+	parsed := make([]*x509.Certificate, 0, len(certificate.Certificate))
+	var endEntities []*x509.Certificate
+	for _, der := range certificate.Certificate {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, nil, ErrInvalidCertificate
+		}
+		parsed = append(parsed, c)
+		if isEndEntity(c) {
+			endEntities = append(endEntities, c)
+		}
+	}
+
+	x509Cert := parsed[0]
+	if len(endEntities) > 1 {
+		// A messy bundle with multiple end-entity certificates, don't guess which one is the leaf
+		if cfg.leafSelector == nil {
+			return nil, nil, ErrAmbiguousLeaf
+		}
+		var err error
+		x509Cert, err = cfg.leafSelector(endEntities)
+		if err != nil {
+			return nil, nil, err
+		}
+		if x509Cert == nil {
+			return nil, nil, ErrAmbiguousLeaf
+		}
+	}
+
+	chain := make([]*x509.Certificate, 0, len(parsed)-1)
+	for _, c := range parsed {
+		if c != x509Cert {
+			chain = append(chain, c)
+		}
+	}
+
+	// Use the issuer when exactly one certificate in the chain has the leaf's issuer as subject
+	var candidates []*x509.Certificate
+	for _, c := range chain {
+		if bytes.Equal(c.RawSubject, x509Cert.RawIssuer) {
+			candidates = append(candidates, c)
+		}
+	}
+	if len(candidates) > 1 && len(x509Cert.AuthorityKeyId) > 0 {
+		// Narrow down by key identifier, e.g. for a cross-signed or re-keyed issuer with the same name
+		var matching []*x509.Certificate
+		for _, c := range candidates {
+			if bytes.Equal(c.SubjectKeyId, x509Cert.AuthorityKeyId) {
+				matching = append(matching, c)
+			}
+		}
+		if len(matching) > 0 {
+			candidates = matching
+		}
+	}
+	if len(candidates) == 1 {
+		return x509Cert, candidates[0], nil
+	}
+	if len(candidates) > 1 {
+		// The name, and key identifier if any, is ambiguous, the issuer is the candidate that signed the leaf. This also
+		// covers leaves without authority key identifier.
+		for _, c := range candidates {
+			if x509Cert.CheckSignatureFrom(c) == nil {
+				return x509Cert, c, nil
+			}
+		}
+		if cfg.issuerResolver == nil {
+			return nil, nil, ErrIssuerNotFound
+		}
+	}
+
+	// The issuer isn't unambiguous in the chain, let the caller resolve it
+	if cfg.issuerResolver != nil {
+		x509Issuer, err := cfg.issuerResolver(x509Cert)
+		if err != nil {
+			return nil, nil, err
+		}
+		if x509Issuer == nil {
+			return nil, nil, ErrMissingIssuer
+		}
+		return x509Cert, x509Issuer, nil
+	}
+
+	if len(candidates) == 0 && cfg.aiaIssuers != nil {
+		// The issuer is missing from the chain, use the one downloaded from the AIA extension of the leaf
+		if x509Issuer := cfg.aiaIssuers.lookup(x509Cert); x509Issuer != nil {
+			return x509Cert, x509Issuer, nil
+		}
+	}
+
+	// The second certificate in the chain should be the issuer's certificate. The leaf itself is fine, but without the issuer
+	// no OCSP request can be built
+	if len(chain) == 0 {
+		return nil, nil, ErrMissingIssuer
+	}
+	return x509Cert, chain[0], nil
+}
+
+// postOCSP POSTs the ocspRequest to the ocspServer, parses the response using the issuer and verifies it matches the request.
+// returns the raw and parsed response or an error in case something went wrong.
+func postOCSP(ctx context.Context, httpClient *http.Client, ocspServer string, ocspRequest *fetchRequest, cfg *config) (*fetchResult, error) {
+	start := time.Now()
+	if cfg.fetchTimeout > 0 {
+		// The deadline also covers reading the body, so a responder trickling its response can't stall the fetch
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.fetchTimeout)
+		defer cancel()
+	}
+
+	var addrs []string
+	var addrsLock sync.Mutex
+	if cfg.httpTrace {
+		ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+			DNSDone: func(info httptrace.DNSDoneInfo) {
+				addrsLock.Lock()
+				defer addrsLock.Unlock()
+				addrs = addrs[:0]
+				for _, addr := range info.Addrs {
+					addrs = append(addrs, addr.String())
+				}
+			},
+		})
+	}
+
+	// POST the OCSP request to the ocspServer defined in the 'Owner certificate'
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, ocspServer, bytes.NewReader(ocspRequest.der))
+	if err != nil {
+		return nil, ErrCouldNotPostOCSPRequest
+	}
+	request.Header.Set("Content-Type", "application/ocsp-request")
+	// Closing the connection through the request works with any round tripper, not only *http.Transport
+	request.Close = cfg.disableKeepAlive
+
+	ocspResponse, err := httpClient.Do(request)
+	if err != nil {
+		return nil, ErrCouldNotPostOCSPRequest
+	}
+
+	if ocspResponse.StatusCode != http.StatusOK {
+		// Don't try to parse error pages, e.g. of an overloaded responder
+		_ = ocspResponse.Body.Close()
+		return nil, &HTTPStatusError{StatusCode: ocspResponse.StatusCode}
+	}
+	// Some responders send valid responses with the wrong content type, so a mismatch only adds context to a parse error
+	contentType := ocspResponse.Header.Get("Content-Type")
+	contentTypeMismatch := !isOCSPResponseContentType(contentType)
+
+	// Read the ocsp response body
+	ocspResponseData, err := io.ReadAll(ocspResponse.Body)
+	cfg.countFetchedBytes(len(ocspResponseData))
+	if err != nil {
+		return nil, ErrCouldNotReadOCSPResponse
+	}
+
+	if err := ocspResponse.Body.Close(); err != nil {
+		return nil, ErrCouldNotCloseBody
+	}
+	if len(ocspResponseData) == 0 {
+		// Some responders return 200 without a body when they are overloaded
+		return nil, ErrEmptyResponse
+	}
+
+	// Everything up to here is attributed to the network, parsing and verifying is local work
+	parseStart := time.Now()
+	response, err := parseResponse(ocspResponseData, ocspRequest.issuer, cfg)
+	if err != nil {
+		if contentTypeMismatch {
+			return nil, fmt.Errorf("%w: %w %q", err, ErrUnexpectedContentType, contentType)
+		}
+		return nil, err
+	}
+	if contentTypeMismatch {
+		cfg.logger.Debug("ocspstapling: accepted OCSP response with unexpected content type",
+			"responder", ocspServer, "contentType", contentType)
+	}
+	if response.SerialNumber.Cmp(ocspRequest.serial) != 0 {
+		// A misbehaving responder answered for another certificate, stapling it would mask the status of the leaf
+		return nil, ErrOCSPSerialMismatch
+	}
+	if err := checkResponseTime(response, time.Now(), cfg); err != nil {
+		return nil, err
+	}
+	if ocspRequest.nonce != nil {
+		if err := checkNonce(ocspResponseData, ocspRequest.nonce, cfg.lenientNonce); err != nil {
+			return nil, err
+		}
+	}
+
+	addrsLock.Lock()
+	defer addrsLock.Unlock()
+	return &fetchResult{
+		raw:         ocspResponseData,
+		response:    response,
+		cacheExpiry: httpCacheExpiry(ocspResponse.Header, start),
+		info: FetchInfo{
+			Responder:       ocspServer,
+			NetworkDuration: parseStart.Sub(start),
+			ParseDuration:   time.Since(parseStart),
+			ResponderAddrs:  append([]string(nil), addrs...),
+		},
+	}, nil
+}
+
+// checkResponseTime rejects a fetched response that is not valid at now, e.g. a replayed response or one from a responder
+// with a skewed clock. ThisUpdate may be up to the configured clock skew in the future.
+func checkResponseTime(response *ocsp.Response, now time.Time, cfg *config) error {
+	if response.ThisUpdate.After(now.Add(cfg.clockSkew)) {
+		return ErrOCSPResponseExpired
+	}
+	if !response.NextUpdate.IsZero() && !response.NextUpdate.After(now) {
+		return ErrOCSPResponseExpired
+	}
+	return nil
+}
+
+// parseResponse parses the raw OCSP response, verifies its signature and checks it against the configured policies
+func parseResponse(ocspResponseData []byte, x509Issuer *x509.Certificate, cfg *config) (*ocsp.Response, error) {
+	var response *ocsp.Response
+	var err error
+	if cfg.responseVerifier != nil {
+		response, err = cfg.responseVerifier(ocspResponseData, x509Issuer)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrCouldNotParseResponse, err)
+		}
+	} else {
+		response, err = parseSignedResponse(ocspResponseData, x509Issuer, cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.requireNextUpdate && response.NextUpdate.IsZero() {
+		return nil, ErrMissingNextUpdate
+	}
+
+	if len(cfg.allowedSignatureAlgorithms) > 0 {
+		if !containsSignatureAlgorithm(cfg.allowedSignatureAlgorithms, response.SignatureAlgorithm) {
+			return nil, ErrWeakResponseSignature
+		}
+		// The embedded responder certificate is part of the chain of trust, so it is held to the same standard
+		if response.Certificate != nil && !containsSignatureAlgorithm(cfg.allowedSignatureAlgorithms, response.Certificate.SignatureAlgorithm) {
+			return nil, ErrWeakResponseSignature
+		}
+	}
+
+	return response, nil
+}
+
+// parseSignedResponse parses the raw OCSP response and verifies it was signed by the issuer, or by a responder certificate
+// issued by the issuer.
+func parseSignedResponse(ocspResponseData []byte, x509Issuer *x509.Certificate, cfg *config) (*ocsp.Response, error) {
+	if !cfg.embeddedResponderCert && cfg.verifyRoots == nil {
+		response, err := ocsp.ParseResponse(ocspResponseData, x509Issuer)
+		if err != nil {
+			return nil, ErrCouldNotParseResponse
+		}
+		return response, nil
+	}
+
+	// Parse without the issuer, the signature is checked against the responder certificate embedded in the response
+	response, err := ocsp.ParseResponse(ocspResponseData, nil)
+	if err != nil {
+		return nil, ErrCouldNotParseResponse
+	}
+
+	if response.Certificate == nil {
+		// Nothing embedded, so the issuer must have signed the response directly
+		if err := response.CheckSignatureFrom(x509Issuer); err != nil {
+			return nil, ErrCouldNotParseResponse
+		}
+		return response, nil
+	}
+
+	if cfg.verifyRoots != nil {
+		// The embedded responder certificate must chain to one of the roots and be allowed to sign OCSP responses
+		intermediates := x509.NewCertPool()
+		intermediates.AddCert(x509Issuer)
+		chains, err := response.Certificate.Verify(x509.VerifyOptions{
+			Roots:         cfg.verifyRoots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning},
+		})
+		if err != nil {
+			return nil, ErrInvalidResponderCertificate
+		}
+		// Serial numbers are only unique per CA, so a responder of another CA in the pool must not vouch for the leaf
+		if !chainsContain(chains, x509Issuer) {
+			return nil, ErrInvalidResponderCertificate
+		}
+		return response, nil
+	}
+
+	// The embedded responder certificate must be issued by the issuer and be allowed to sign OCSP responses
+	if err := response.Certificate.CheckSignatureFrom(x509Issuer); err != nil {
+		return nil, ErrInvalidResponderCertificate
+	}
+	if !hasExtKeyUsage(response.Certificate, x509.ExtKeyUsageOCSPSigning) {
+		return nil, ErrInvalidResponderCertificate
+	}
+
+	return response, nil
+}
+
+// chainsContain reports whether any of the verified chains contains the certificate
+func chainsContain(chains [][]*x509.Certificate, certificate *x509.Certificate) bool {
+	for _, chain := range chains {
+		for _, c := range chain {
+			if c.Equal(certificate) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isEndEntity reports whether the certificate can be the leaf of a chain. Besides CA certificates, this excludes certificates
+// that may sign certificates or are self-signed, e.g. v1 roots and intermediates without basic constraints.
+func isEndEntity(certificate *x509.Certificate) bool {
+	if certificate.IsCA || certificate.KeyUsage&x509.KeyUsageCertSign != 0 {
+		return false
+	}
+	selfSigned := bytes.Equal(certificate.RawSubject, certificate.RawIssuer) &&
+		certificate.CheckSignature(certificate.SignatureAlgorithm, certificate.RawTBSCertificate, certificate.Signature) == nil
+	return !selfSigned
+}
+
+// hasExtKeyUsage reports whether the certificate contains the extended key usage
+func hasExtKeyUsage(certificate *x509.Certificate, usage x509.ExtKeyUsage) bool {
+	for _, u := range certificate.ExtKeyUsage {
+		if u == usage {
+			return true
+		}
+	}
+	return false
+}
+
+// containsSignatureAlgorithm reports whether algorithm is one of algorithms
+func containsSignatureAlgorithm(algorithms []x509.SignatureAlgorithm, algorithm x509.SignatureAlgorithm) bool {
+	for _, a := range algorithms {
+		if a == algorithm {
+			return true
+		}
+	}
+	return false
+}
+
+// isOCSPResponseContentType reports whether the Content-Type header is application/ocsp-response. Parameters such as a charset
+// are ignored, and a missing header is accepted.
+func isOCSPResponseContentType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/ocsp-response"
+}
+
+// httpCacheExpiry returns when an HTTP response received at now expires, as set by RFC 5019 responders. The Cache-Control
+// max-age directive, reduced by the Age header, takes precedence over the Expires header. It returns the zero time when
+// neither is present or valid.
+func httpCacheExpiry(header http.Header, now time.Time) time.Time {
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		name, value, found := strings.Cut(strings.TrimSpace(directive), "=")
+		if !found || !strings.EqualFold(name, "max-age") {
+			continue
+		}
+		maxAge, err := strconv.ParseInt(strings.Trim(value, `"`), 10, 64)
+		if err != nil || maxAge < 0 {
+			return time.Time{}
+		}
+		if age, err := strconv.ParseInt(header.Get("Age"), 10, 64); err == nil && age > 0 {
+			maxAge -= age
+		}
+		return now.Add(time.Duration(maxAge) * time.Second)
+	}
+
+	if expires := header.Get("Expires"); expires != "" {
+		if t, err := http.ParseTime(expires); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// logAttempt logs the outcome of a single request to an OCSP responder at debug level
+func (cfg *config) logAttempt(attempt FetchAttempt) {
+	if attempt.Err != nil {
+		cfg.logger.Debug("ocspstapling: OCSP fetch attempt failed",
+			"responder", attempt.Responder, "hash", attempt.Hash.String(), "method", attempt.Method, "error", attempt.Err)
+		return
+	}
+	cfg.logger.Debug("ocspstapling: OCSP fetch attempt succeeded",
+		"responder", attempt.Responder, "hash", attempt.Hash.String(), "method", attempt.Method)
+}
@@ -0,0 +1,228 @@
+package ocspstapling
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"golang.org/x/crypto/ocsp"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseSignedResponseVerifyRootsRequiresIssuer(t *testing.T) {
+	issuer := newTestCA(t, "issuer")
+	other := newTestCA(t, "other")
+	roots := x509.NewCertPool()
+	roots.AddCert(issuer.cert)
+	roots.AddCert(other.cert)
+	cfg := newConfig([]Option{WithVerifyRoots(roots)})
+
+	serial := big.NewInt(42)
+	tests := []struct {
+		name string
+		ca   *testCA
+		want error
+	}{
+		{name: "responder of the issuer", ca: issuer},
+		{name: "responder of another CA", ca: other, want: ErrInvalidResponderCertificate},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			responder, key := tt.ca.issue(t, &x509.Certificate{
+				SerialNumber: big.NewInt(2),
+				Subject:      pkix.Name{CommonName: "responder"},
+				KeyUsage:     x509.KeyUsageDigitalSignature,
+				ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning},
+			})
+			raw, err := ocsp.CreateResponse(issuer.cert, responder, ocsp.Response{
+				Status:       ocsp.Good,
+				SerialNumber: serial,
+				ThisUpdate:   time.Now(),
+				NextUpdate:   time.Now().Add(time.Hour),
+				Certificate:  responder,
+			}, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = parseSignedResponse(raw, issuer.cert, &cfg)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("parseSignedResponse() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestEmptyResponseIsRetried(t *testing.T) {
+	ca := newTestCA(t, "issuer")
+	// The first request is answered with 200 and no body, the following ones with a valid response
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		response, err := ca.respond(t, r, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer response.Body.Close()
+		w.Header().Set("Content-Type", response.Header.Get("Content-Type"))
+		_, _ = io.Copy(w, response.Body)
+	}))
+	defer server.Close()
+	certificate := ca.certificate(t, x509.Certificate{OCSPServer: []string{server.URL}})
+
+	cfg := newConfig(nil)
+	_, err := fetchOCSP(context.Background(), certificate, cfg.newHTTPClient(), &cfg)
+	if !errors.Is(err, ErrEmptyResponse) {
+		t.Fatalf("fetchOCSP() error = %v, want ErrEmptyResponse", err)
+	}
+	if !isRetryable(err) {
+		t.Fatalf("isRetryable(%v) = false, want true", err)
+	}
+
+	requests.Store(0)
+	if _, err := NewStaplingE(context.Background(), certificate, WithRetryBackoff(Backoff{Base: time.Millisecond})); err != nil {
+		t.Fatalf("NewStaplingE() error = %v", err)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Fatalf("%d requests, want 2", got)
+	}
+}
+
+func TestIsOCSPResponseContentType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"application/ocsp-response", true},
+		{"application/ocsp-response; charset=utf-8", true},
+		{"Application/OCSP-Response", true},
+		{"", true},
+		{"text/html", false},
+		{"application/ocsp-request", false},
+		{"application/ocsp-response; charset", false},
+		{"garbage/", false},
+	}
+	for _, tt := range tests {
+		if got := isOCSPResponseContentType(tt.contentType); got != tt.want {
+			t.Errorf("isOCSPResponseContentType(%q) = %v, want %v", tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestParseChainLeafWithoutAuthorityKeyID(t *testing.T) {
+	// Two CAs with the same name, only the first signed the leaf
+	issuer := newTestCA(t, "issuer")
+	other := newTestCA(t, "issuer")
+	// Without subject key identifier on the parent, the leaf gets no authority key identifier
+	parent := *issuer.cert
+	parent.SubjectKeyId = nil
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "leaf"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}, &parent, key.Public(), issuer.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leaf.AuthorityKeyId) != 0 {
+		t.Fatal("leaf has an authority key identifier")
+	}
+
+	cfg := newConfig(nil)
+	_, got, err := parseChain(tls.Certificate{Certificate: [][]byte{der, other.cert.Raw, issuer.cert.Raw}}, &cfg)
+	if err != nil {
+		t.Fatalf("parseChain() error = %v", err)
+	}
+	if !bytes.Equal(got.Raw, issuer.cert.Raw) {
+		t.Fatal("parseChain() picked the CA that didn't sign the leaf")
+	}
+	_, _, err = parseChain(tls.Certificate{Certificate: [][]byte{der, other.cert.Raw, other.cert.Raw}}, &cfg)
+	if !errors.Is(err, ErrIssuerNotFound) {
+		t.Fatalf("parseChain() error = %v, want ErrIssuerNotFound", err)
+	}
+}
+
+func TestParseChainWithoutBasicConstraints(t *testing.T) {
+	// create signs template with the key of parent, or self-signs it without parent
+	create := func(template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.NotBefore = time.Now().Add(-time.Hour)
+		template.NotAfter = time.Now().Add(24 * time.Hour)
+		if parent == nil {
+			parent, parentKey = template, key
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert, key
+	}
+	// A root like a v1 certificate, and an intermediate that only has the certificate signing key usage
+	root, rootKey := create(&x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "root"}}, nil, nil)
+	intermediate, intermediateKey := create(&x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "intermediate"},
+		KeyUsage:     x509.KeyUsageCertSign,
+	}, root, rootKey)
+	leaf, _ := create(&x509.Certificate{SerialNumber: big.NewInt(42), Subject: pkix.Name{CommonName: "leaf"}}, intermediate,
+		intermediateKey)
+
+	cfg := newConfig(nil)
+	got, issuer, err := parseChain(tls.Certificate{Certificate: [][]byte{leaf.Raw, intermediate.Raw, root.Raw}}, &cfg)
+	if err != nil {
+		t.Fatalf("parseChain() error = %v", err)
+	}
+	if !bytes.Equal(got.Raw, leaf.Raw) || !bytes.Equal(issuer.Raw, intermediate.Raw) {
+		t.Fatalf("parseChain() = %q issued by %q, want leaf issued by intermediate", got.Subject.CommonName,
+			issuer.Subject.CommonName)
+	}
+}
+
+func TestResponderURLWithPathAndQuery(t *testing.T) {
+	ca := newTestCA(t, "issuer")
+	certificate := ca.certificate(t, x509.Certificate{OCSPServer: []string{"http://ocsp.example/tenant/ocsp?profile=tls&v=2"}})
+	var requested string
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		requested = r.URL.String()
+		return ca.respond(t, r, time.Now())
+	})
+
+	cfg := newConfig([]Option{WithTransport(transport)})
+	if _, err := fetchOCSP(context.Background(), certificate, cfg.newHTTPClient(), &cfg); err != nil {
+		t.Fatalf("fetchOCSP() error = %v", err)
+	}
+	if want := "http://ocsp.example/tenant/ocsp?profile=tls&v=2"; requested != want {
+		t.Fatalf("requested %q, want %q", requested, want)
+	}
+}
@@ -1,5 +1,5 @@
 module github.com/rubenwo/ocspstapling
 
-go 1.17
+go 1.21
 
 require golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
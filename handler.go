@@ -0,0 +1,49 @@
+package ocspstapling
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Handler returns an http.Handler that serves the current raw OCSP response, so this instance can distribute its staple to
+// other nodes. The response has Content-Type application/ocsp-response and caching headers derived from the ThisUpdate and
+// NextUpdate of the staple, as recommended by RFC 5019. A staple without NextUpdate is served with Cache-Control no-cache.
+// 503 Service Unavailable is returned when there is no valid staple.
+func (s *Stapling) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		s.lock.RLock()
+		valid := s.hasValidStaple()
+		staple := s.certificate.OCSPStaple
+		thisUpdate, nextUpdate := s.thisUpdate, s.nextUpdate
+		s.lock.RUnlock()
+
+		if !valid {
+			http.Error(w, ErrNoValidStaple.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		header := w.Header()
+		header.Set("Content-Type", "application/ocsp-response")
+		header.Set("Content-Length", strconv.Itoa(len(staple)))
+		header.Set("Last-Modified", thisUpdate.UTC().Format(http.TimeFormat))
+		if nextUpdate.IsZero() {
+			// Newer information may be available at any time, so caches must revalidate every time
+			header.Set("Cache-Control", "no-cache, public, no-transform")
+		} else {
+			maxAge := int64(time.Until(nextUpdate) / time.Second)
+			header.Set("Cache-Control", "max-age="+strconv.FormatInt(maxAge, 10)+", public, no-transform, must-revalidate")
+			header.Set("Expires", nextUpdate.UTC().Format(http.TimeFormat))
+		}
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(staple)
+		}
+	})
+}
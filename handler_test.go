@@ -0,0 +1,55 @@
+package ocspstapling
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	ca, certificate := newTestCertificate(t)
+	now := time.Now()
+
+	tests := []struct {
+		name             string
+		nextUpdate       time.Time
+		wantStatus       int
+		wantCacheControl string
+	}{
+		{"valid", now.Add(time.Hour), http.StatusOK, "max-age="},
+		{"without NextUpdate", time.Time{}, http.StatusOK, "no-cache"},
+		{"expired", now.Add(-time.Minute), http.StatusServiceUnavailable, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewStaplingE(context.Background(), certificate, WithTransport(ca.transport(t)),
+				WithImportTolerance(time.Hour))
+			if err != nil {
+				t.Fatalf("NewStaplingE() error = %v", err)
+			}
+			raw := ca.staple(t, 42, now.Add(-2*time.Hour), tt.nextUpdate)
+			if err := s.SetStaple(raw); err != nil {
+				t.Fatalf("SetStaple() error = %v", err)
+			}
+
+			recorder := httptest.NewRecorder()
+			s.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+			if recorder.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", recorder.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if !bytes.Equal(recorder.Body.Bytes(), raw) {
+				t.Error("body isn't the staple")
+			}
+			if got := recorder.Header().Get("Cache-Control"); !strings.HasPrefix(got, tt.wantCacheControl) {
+				t.Errorf("Cache-Control = %q, want prefix %q", got, tt.wantCacheControl)
+			}
+		})
+	}
+}
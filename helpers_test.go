@@ -0,0 +1,165 @@
+package ocspstapling
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"golang.org/x/crypto/ocsp"
+	"io"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority for tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCA creates a self-signed CA with the common name name
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// issue signs a certificate for template with a new key. The validity period is filled in when it isn't set.
+func (ca *testCA) issue(t *testing.T, template *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if template.NotBefore.IsZero() {
+		template.NotBefore = time.Now().Add(-time.Hour)
+		template.NotAfter = time.Now().Add(24 * time.Hour)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// roundTripFunc is an http.RoundTripper calling the function, see WithTransport
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// transport answers OCSP requests with a good response signed by the CA, and serves the CA certificate on GET requests,
+// like a CA Issuers URL
+func (ca *testCA) transport(t *testing.T) roundTripFunc {
+	return func(r *http.Request) (*http.Response, error) {
+		if r.Method == http.MethodGet {
+			return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(bytes.NewReader(ca.cert.Raw))}, nil
+		}
+		return ca.respond(t, r, time.Now())
+	}
+}
+
+// respond answers the OCSP request r with a good response produced at thisUpdate, valid for an hour
+func (ca *testCA) respond(t *testing.T, r *http.Request, thisUpdate time.Time) (*http.Response, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	request, err := ocsp.ParseRequest(body)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := ocsp.CreateResponse(ca.cert, ca.cert, ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: request.SerialNumber,
+		ThisUpdate:   thisUpdate,
+		NextUpdate:   thisUpdate.Add(time.Hour),
+	}, ca.key)
+	if err != nil {
+		t.Error(err)
+		return nil, err
+	}
+	header := http.Header{"Content-Type": {"application/ocsp-response"}}
+	return &http.Response{StatusCode: http.StatusOK, Header: header, Body: io.NopCloser(bytes.NewReader(raw))}, nil
+}
+
+// eventually fails the test when condition doesn't hold within five seconds
+func eventually(t *testing.T, condition func() bool, format string, args ...any) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf(format, args...)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// certificate issues a leaf for template and returns it with the CA certificate as chain. Unset fields of template default
+// to serial number 42, common name "leaf" and the OCSP server http://ocsp.example/.
+func (ca *testCA) certificate(t *testing.T, template x509.Certificate) tls.Certificate {
+	t.Helper()
+	if template.SerialNumber == nil {
+		template.SerialNumber = big.NewInt(42)
+	}
+	if template.Subject.CommonName == "" {
+		template.Subject.CommonName = "leaf"
+	}
+	if template.OCSPServer == nil {
+		template.OCSPServer = []string{"http://ocsp.example/"}
+	}
+	leaf, key := ca.issue(t, &template)
+	return tls.Certificate{Certificate: [][]byte{leaf.Raw, ca.cert.Raw}, PrivateKey: key, Leaf: leaf}
+}
+
+// newTestCertificate creates a CA and a leaf issued by it with the defaults of testCA.certificate
+func newTestCertificate(t *testing.T) (*testCA, tls.Certificate) {
+	t.Helper()
+	ca := newTestCA(t, "issuer")
+	return ca, ca.certificate(t, x509.Certificate{})
+}
+
+// staple returns a raw good response for the certificate with the serial number, signed by the CA
+func (ca *testCA) staple(t *testing.T, serial int64, thisUpdate, nextUpdate time.Time) []byte {
+	t.Helper()
+	raw, err := ocsp.CreateResponse(ca.cert, ca.cert, ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: big.NewInt(serial),
+		ThisUpdate:   thisUpdate,
+		NextUpdate:   nextUpdate,
+	}, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
@@ -0,0 +1,60 @@
+package ocspstapling
+
+import (
+	"crypto"
+	"errors"
+	"time"
+)
+
+// defaultErrorHistory is the number of errors kept for RecentErrors when WithErrorHistory is not used
+const defaultErrorHistory = 16
+
+// TimedError is an error that occurred while renewing the staple
+type TimedError struct {
+	Time time.Time
+	Err  error
+	// Responder and Hash describe the request that failed, they are empty when the error occurred before contacting a responder
+	Responder string
+	Hash      crypto.Hash
+}
+
+// errorHistory is a fixed size ring buffer of the most recent errors
+type errorHistory struct {
+	errors []TimedError
+	// next is the index the next error is written to
+	next int
+	// full is set once the buffer wrapped around
+	full bool
+}
+
+// add records err in the history. When err is a *FetchError, every failed attempt is recorded with its responder and hash.
+func (h *errorHistory) add(now time.Time, err error) {
+	if len(h.errors) == 0 {
+		return
+	}
+
+	var fetchErr *FetchError
+	if !errors.As(err, &fetchErr) {
+		h.push(TimedError{Time: now, Err: err})
+		return
+	}
+	for _, attempt := range fetchErr.Attempts {
+		h.push(TimedError{Time: now, Err: attempt.Err, Responder: attempt.Responder, Hash: attempt.Hash})
+	}
+}
+
+func (h *errorHistory) push(err TimedError) {
+	h.errors[h.next] = err
+	h.next = (h.next + 1) % len(h.errors)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// list returns the recorded errors, oldest first
+func (h *errorHistory) list() []TimedError {
+	if !h.full {
+		return append([]TimedError(nil), h.errors[:h.next]...)
+	}
+	return append(append([]TimedError(nil), h.errors[h.next:]...), h.errors[:h.next]...)
+}
@@ -0,0 +1,274 @@
+package ocspstapling
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Manager staples multiple certificates, e.g. for a server with virtual hosts, and picks the certificate to serve by SNI.
+// Each certificate is handled by its own Stapling.
+type Manager struct {
+	opts []Option
+	// jitFetchTimeout is the timeout of fetches made by GetCertificate, see WithJITFetch
+	jitFetchTimeout time.Duration
+
+	// ctx is the base context of the fetches made by GetCertificate, it is cancelled by Close
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// staplings holds the Stapling of every added certificate in the order they were added, the first one is the default
+	staplings []*Stapling
+	// byName maps the lowercase DNS names of the certificates, including wildcard names, to their Stapling
+	byName map[string]*Stapling
+
+	// runCtx is the context of Run while it is running, new certificates start their renewal loop with it
+	runCtx  context.Context
+	running sync.WaitGroup
+
+	lock sync.RWMutex
+}
+
+// NewManager creates a Manager without certificates. opts are applied to the Stapling of every certificate added, invalid
+// options make Add fail with ErrInvalidOption.
+func NewManager(opts ...Option) *Manager {
+	cfg := newConfig(opts)
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Manager{
+		opts:            opts,
+		jitFetchTimeout: cfg.jitFetchTimeout,
+		ctx:             ctx,
+		cancel:          cancel,
+		byName:          make(map[string]*Stapling),
+	}
+}
+
+// NewManagerFromPEM creates a Manager like NewManager, and adds every certificate chain in pemData, e.g. files produced by an
+// ACME client. A chain starts at an end-entity certificate and contains the certificates up to the next one. Each chain is
+// paired with the private key in keyData that matches its leaf. ctx is used like in Add. An error is returned when pemData
+// contains no certificate, a chain has no matching key, or an option is invalid. Otherwise the Manager is returned, even
+// when OCSP stapling can't be used for some certificates, the joined errors of Add then tell why.
+func NewManagerFromPEM(ctx context.Context, pemData, keyData []byte, opts ...Option) (*Manager, error) {
+	var keys [][]byte
+	for rest := keyData; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			keys = append(keys, pem.EncodeToMemory(block))
+		}
+	}
+
+	// Split the certificates into chains, each starting at an end-entity certificate
+	var chains [][]byte
+	for rest := pemData; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, ErrInvalidCertificate
+		}
+		if isEndEntity(c) {
+			chains = append(chains, nil)
+		} else if len(chains) == 0 {
+			// The bundle must start with a leaf
+			return nil, ErrInvalidCertificate
+		}
+		chains[len(chains)-1] = append(chains[len(chains)-1], pem.EncodeToMemory(block)...)
+	}
+	if len(chains) == 0 {
+		return nil, ErrNoCertificate
+	}
+
+	certificates := make([]tls.Certificate, 0, len(chains))
+	for _, chain := range chains {
+		certificate, err := pairKey(chain, keys)
+		if err != nil {
+			return nil, err
+		}
+		certificates = append(certificates, certificate)
+	}
+
+	m := NewManager(opts...)
+	var errs []error
+	for _, certificate := range certificates {
+		if _, err := m.Add(ctx, certificate); err != nil {
+			if errors.Is(err, ErrInvalidOption) {
+				return nil, err
+			}
+			errs = append(errs, err)
+		}
+	}
+	return m, errors.Join(errs...)
+}
+
+// pairKey returns the certificate of the PEM encoded chain with the first of the PEM encoded keys that matches its leaf
+func pairKey(chain []byte, keys [][]byte) (tls.Certificate, error) {
+	for _, key := range keys {
+		if certificate, err := tls.X509KeyPair(chain, key); err == nil {
+			return certificate, nil
+		}
+	}
+	leaf, _ := pem.Decode(chain)
+	c, err := x509.ParseCertificate(leaf.Bytes)
+	if err != nil {
+		return tls.Certificate{}, ErrInvalidCertificate
+	}
+	return tls.Certificate{}, fmt.Errorf("%w: %s", ErrNoMatchingKey, c.Subject)
+}
+
+// Add creates a Stapling for the certificate and serves it for the DNS names of its leaf. When a name is already served by
+// another certificate, the certificate added first keeps serving it. The context is used like in NewStapling. The certificate
+// is added even when OCSP stapling can't be used for it, the returned error tells why, see NewStaplingE. Only invalid options,
+// see ErrInvalidOption, prevent adding it. When Run is running, the renewal loop of the certificate is started immediately.
+func (m *Manager) Add(ctx context.Context, certificate tls.Certificate) (*Stapling, error) {
+	if len(certificate.Certificate) == 0 {
+		return nil, ErrInvalidCertificate
+	}
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return nil, ErrInvalidCertificate
+	}
+
+	s, err := NewStaplingE(ctx, certificate, m.opts...)
+	if errors.Is(err, ErrInvalidOption) {
+		return nil, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.staplings = append(m.staplings, s)
+	for _, name := range leaf.DNSNames {
+		name = strings.ToLower(name)
+		if _, ok := m.byName[name]; !ok {
+			m.byName[name] = s
+		}
+	}
+	if m.runCtx != nil {
+		m.runRenewal(s)
+	}
+	return s, err
+}
+
+// Run runs the renewal loops of all certificates until ctx is cancelled or Close is called, including the ones added while it
+// runs. It returns once all renewal loops have stopped.
+func (m *Manager) Run(ctx context.Context) {
+	m.lock.Lock()
+	m.runCtx = ctx
+	for _, s := range m.staplings {
+		m.runRenewal(s)
+	}
+	m.lock.Unlock()
+
+	select {
+	case <-ctx.Done():
+	case <-m.ctx.Done():
+	}
+
+	m.lock.Lock()
+	m.runCtx = nil
+	m.lock.Unlock()
+	m.running.Wait()
+}
+
+// CacheStats returns the sum of the Stapling.CacheStats of all certificates, e.g. to confirm a shared store reduces the
+// load on the responders
+func (m *Manager) CacheStats() (hits, misses uint64) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	for _, s := range m.staplings {
+		stapleHits, stapleMisses := s.CacheStats()
+		hits += stapleHits
+		misses += stapleMisses
+	}
+	return hits, misses
+}
+
+// runRenewal starts the renewal loop of s. The caller must hold the lock.
+func (m *Manager) runRenewal(s *Stapling) {
+	m.running.Add(1)
+	go func(ctx context.Context) {
+		defer m.running.Done()
+		s.RunOCSPRenewal(ctx)
+	}(m.runCtx)
+}
+
+// Close cancels the fetches made by GetCertificate, and closes the Stapling of every certificate, which stops their renewal
+// loops and saves their staples to the store, see Stapling.Close. A running Run returns. The errors of saving are returned
+// joined.
+func (m *Manager) Close() error {
+	m.cancel()
+
+	m.lock.RLock()
+	staplings := append([]*Stapling(nil), m.staplings...)
+	m.lock.RUnlock()
+
+	var errs []error
+	for _, s := range staplings {
+		errs = append(errs, s.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// GetCertificate returns the stapled certificate whose DNS names match the server name of the ClientHello, it can be
+// assigned directly to tls.Config.GetCertificate. Wildcard names match a single label. When no certificate matches, or the
+// client didn't send SNI, the certificate added first is returned. With WithJITFetch, a staple is fetched first when the
+// certificate has none.
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.lock.RLock()
+	s := m.lookup(strings.ToLower(strings.TrimSuffix(hello.ServerName, ".")))
+	m.lock.RUnlock()
+
+	if s == nil {
+		return nil, ErrNoCertificate
+	}
+	if m.jitFetchTimeout > 0 && s.awaitingStaple() {
+		m.fetchJIT(hello, s)
+	}
+	return s.Certificate()
+}
+
+// fetchJIT fetches a staple for s during the handshake of hello. The fetch is shared with concurrent handshakes and
+// cancelled by Close, the handshake waits until the timeout or until it is aborted itself. A failed fetch is recorded by s,
+// the certificate is then served without staple.
+func (m *Manager) fetchJIT(hello *tls.ClientHelloInfo, s *Stapling) {
+	ctx, cancel := context.WithTimeout(m.ctx, m.jitFetchTimeout)
+	defer cancel()
+	if handshakeCtx := hello.Context(); handshakeCtx != nil {
+		stop := context.AfterFunc(handshakeCtx, cancel)
+		defer stop()
+	}
+	_ = s.sharedRenew(ctx, m.ctx)
+}
+
+// lookup returns the Stapling for the lowercase server name, or the default. The caller must hold the lock.
+func (m *Manager) lookup(serverName string) *Stapling {
+	if serverName != "" {
+		if s, ok := m.byName[serverName]; ok {
+			return s
+		}
+		if i := strings.IndexByte(serverName, '.'); i > 0 {
+			if s, ok := m.byName["*"+serverName[i:]]; ok {
+				return s
+			}
+		}
+	}
+	if len(m.staplings) == 0 {
+		return nil
+	}
+	return m.staplings[0]
+}
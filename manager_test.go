@@ -0,0 +1,152 @@
+package ocspstapling
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestManagerJITFetch(t *testing.T) {
+	ca := newTestCA(t, "issuer")
+	certificate := ca.certificate(t, x509.Certificate{Subject: pkix.Name{CommonName: "example.test"}, DNSNames: []string{"example.test"}})
+	hello := &tls.ClientHelloInfo{ServerName: "example.test"}
+
+	tests := []struct {
+		name       string
+		opts       []Option
+		wantStaple bool
+	}{
+		{name: "disabled by default"},
+		{name: "enabled", opts: []Option{WithJITFetch(5 * time.Second)}, wantStaple: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewManager(append(tt.opts, WithTransport(ca.transport(t)))...)
+			defer m.Close()
+			if _, err := m.Add(context.Background(), certificate); err != nil {
+				t.Fatalf("Add() error = %v", err)
+			}
+			served, err := m.GetCertificate(hello)
+			if err != nil {
+				t.Fatalf("GetCertificate() error = %v", err)
+			}
+			if got := len(served.OCSPStaple) > 0; got != tt.wantStaple {
+				t.Fatalf("GetCertificate() stapled = %v, want %v", got, tt.wantStaple)
+			}
+		})
+	}
+}
+
+func TestManagerCloseCancelsJITFetch(t *testing.T) {
+	ca := newTestCA(t, "issuer")
+	certificate := ca.certificate(t, x509.Certificate{Subject: pkix.Name{CommonName: "example.test"}, DNSNames: []string{"example.test"}})
+	// Once the certificate is added, the responder hangs until the request is cancelled
+	var hang atomic.Bool
+	responder := ca.transport(t)
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if hang.Load() {
+			<-r.Context().Done()
+			return nil, r.Context().Err()
+		}
+		return responder(r)
+	})
+	m := NewManager(WithTransport(transport), WithJITFetch(time.Minute))
+	if _, err := m.Add(context.Background(), certificate); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	hang.Store(true)
+	runDone := make(chan struct{})
+	go func() {
+		defer close(runDone)
+		m.Run(context.Background())
+	}()
+
+	served := make(chan *tls.Certificate, 1)
+	go func() {
+		certificate, _ := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.test"})
+		served <- certificate
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if err := m.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	select {
+	case certificate := <-served:
+		if len(certificate.OCSPStaple) != 0 {
+			t.Fatal("GetCertificate() served a staple after Close")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close didn't cancel the fetch of GetCertificate")
+	}
+	select {
+	case <-runDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return after Close")
+	}
+}
+
+func TestNewManagerFromPEM(t *testing.T) {
+	ca := newTestCA(t, "issuer")
+	var certPEM, keyPEM []byte
+	var leaves []*x509.Certificate
+	for i, name := range []string{"a.example", "b.example"} {
+		leaf, key := ca.issue(t, &x509.Certificate{
+			SerialNumber: big.NewInt(int64(42 + i)),
+			Subject:      pkix.Name{CommonName: name},
+			DNSNames:     []string{name},
+			OCSPServer:   []string{"http://ocsp.example/"},
+		})
+		leaves = append(leaves, leaf)
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw})...)
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})...)
+		// The keys are in the opposite order of the certificates, in different encodings
+		var block *pem.Block
+		if i == 0 {
+			der, err := x509.MarshalPKCS8PrivateKey(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+		} else {
+			der, err := x509.MarshalECPrivateKey(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+		}
+		keyPEM = append(pem.EncodeToMemory(block), keyPEM...)
+	}
+
+	m, err := NewManagerFromPEM(context.Background(), certPEM, keyPEM, WithTransport(ca.transport(t)))
+	if err != nil {
+		t.Fatalf("NewManagerFromPEM() error = %v", err)
+	}
+	defer m.Close()
+	for _, leaf := range leaves {
+		served, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: leaf.DNSNames[0]})
+		if err != nil {
+			t.Fatalf("GetCertificate(%q) error = %v", leaf.DNSNames[0], err)
+		}
+		if served.Leaf == nil || !served.Leaf.Equal(leaf) || len(served.Certificate) != 2 {
+			t.Fatalf("GetCertificate(%q) served the wrong chain", leaf.DNSNames[0])
+		}
+	}
+
+	// Without the key of the second certificate
+	first, _ := pem.Decode(keyPEM)
+	if _, err := NewManagerFromPEM(context.Background(), certPEM, pem.EncodeToMemory(first)); !errors.Is(err, ErrNoMatchingKey) {
+		t.Fatalf("NewManagerFromPEM() error = %v, want ErrNoMatchingKey", err)
+	}
+	if _, err := NewManagerFromPEM(context.Background(), nil, keyPEM); !errors.Is(err, ErrNoCertificate) {
+		t.Fatalf("NewManagerFromPEM() error = %v, want ErrNoCertificate", err)
+	}
+}
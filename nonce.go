@@ -0,0 +1,92 @@
+package ocspstapling
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"time"
+)
+
+// nonceSize is the size of the random nonce, as recommended by RFC 8954
+const nonceSize = 32
+
+// oidNonce identifies the nonce extension, see RFC 6960 section 4.4.1
+var oidNonce = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 2}
+
+// These structures reflect the ASN.1 structure of an OCSP response, see RFC 6960 section 4.2.1.
+// golang.org/x/crypto/ocsp doesn't expose the response extensions, which hold the nonce.
+
+type responseASN1 struct {
+	Status        asn1.Enumerated
+	ResponseBytes struct {
+		ResponseType asn1.ObjectIdentifier
+		Response     []byte
+	} `asn1:"explicit,tag:0,optional"`
+}
+
+type basicResponseASN1 struct {
+	TBSResponseData responseDataASN1
+	// The signature and certificates are not needed to find the extensions
+	Rest []asn1.RawValue
+}
+
+type responseDataASN1 struct {
+	Version            int `asn1:"explicit,tag:0,default:0,optional"`
+	RawResponderID     asn1.RawValue
+	ProducedAt         time.Time `asn1:"generalized"`
+	Responses          []asn1.RawValue
+	ResponseExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+// addNonce adds a random nonce extension to the DER encoded unsigned OCSP request. It returns the request and the value of
+// the extension, which the responder echoes in its response.
+func addNonce(ocspRequest []byte) ([]byte, []byte, error) {
+	var unsigned unsignedRequestASN1
+	if rest, err := asn1.Unmarshal(ocspRequest, &unsigned); err != nil || len(rest) != 0 {
+		return nil, nil, ErrCouldNotCreateOCSPRequest
+	}
+
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, ErrCouldNotCreateOCSPRequest
+	}
+	// The extension value is the DER encoded Nonce ::= OCTET STRING, see RFC 8954
+	value, err := asn1.Marshal(nonce)
+	if err != nil {
+		return nil, nil, ErrCouldNotCreateOCSPRequest
+	}
+	unsigned.TBSRequest.RequestExtensions = append(unsigned.TBSRequest.RequestExtensions, pkix.Extension{Id: oidNonce, Value: value})
+
+	der, err := asn1.Marshal(unsigned)
+	if err != nil {
+		return nil, nil, ErrCouldNotCreateOCSPRequest
+	}
+	return der, value, nil
+}
+
+// checkNonce verifies that the raw OCSP response echoes nonce. A response without nonce is accepted when lenient is set.
+func checkNonce(raw []byte, nonce []byte, lenient bool) error {
+	var response responseASN1
+	if _, err := asn1.Unmarshal(raw, &response); err != nil {
+		return ErrCouldNotParseResponse
+	}
+	var basic basicResponseASN1
+	if _, err := asn1.Unmarshal(response.ResponseBytes.Response, &basic); err != nil {
+		return ErrCouldNotParseResponse
+	}
+
+	for _, extension := range basic.TBSResponseData.ResponseExtensions {
+		if extension.Id.Equal(oidNonce) {
+			if !bytes.Equal(extension.Value, nonce) {
+				return ErrOCSPNonceMismatch
+			}
+			return nil
+		}
+	}
+	if lenient {
+		// The responder doesn't support nonces
+		return nil
+	}
+	return ErrOCSPNonceMismatch
+}
@@ -0,0 +1,154 @@
+package ocspstapling
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"golang.org/x/crypto/ocsp"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// requestNonce returns the value of the nonce extension of the unsigned OCSP request, nil when it has none
+func requestNonce(t *testing.T, der []byte) []byte {
+	t.Helper()
+	var request unsignedRequestASN1
+	if _, err := asn1.Unmarshal(der, &request); err != nil {
+		t.Fatalf("could not parse request: %v", err)
+	}
+	for _, extension := range request.TBSRequest.RequestExtensions {
+		if extension.Id.Equal(oidNonce) {
+			return extension.Value
+		}
+	}
+	return nil
+}
+
+// addResponseNonce adds a nonce extension with value to the raw OCSP response, and signs it again with the key of the CA.
+// golang.org/x/crypto/ocsp can only create responses without response extensions.
+func (ca *testCA) addResponseNonce(t *testing.T, raw []byte, value []byte) []byte {
+	t.Helper()
+	type basicResponse struct {
+		TBSResponseData    asn1.RawValue
+		SignatureAlgorithm pkix.AlgorithmIdentifier
+		Signature          asn1.BitString
+		Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+	}
+	var response responseASN1
+	var basic basicResponse
+	var data responseDataASN1
+	if _, err := asn1.Unmarshal(raw, &response); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := asn1.Unmarshal(response.ResponseBytes.Response, &basic); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := asn1.Unmarshal(basic.TBSResponseData.FullBytes, &data); err != nil {
+		t.Fatal(err)
+	}
+
+	data.ResponseExtensions = append(data.ResponseExtensions, pkix.Extension{Id: oidNonce, Value: value})
+	tbs, err := asn1.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(tbs)
+	signature, err := ecdsa.SignASN1(rand.Reader, ca.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	basic.TBSResponseData = asn1.RawValue{FullBytes: tbs}
+	basic.Signature = asn1.BitString{Bytes: signature, BitLength: 8 * len(signature)}
+	if response.ResponseBytes.Response, err = asn1.Marshal(basic); err != nil {
+		t.Fatal(err)
+	}
+	if raw, err = asn1.Marshal(response); err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestAddNonce(t *testing.T) {
+	ca, certificate := newTestCertificate(t)
+	leaf := certificate.Leaf
+	der, err := ocsp.CreateRequest(leaf, ca.cert, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, nonce, err := addNonce(der)
+	if err != nil {
+		t.Fatalf("addNonce() error = %v", err)
+	}
+	if got := requestNonce(t, first); !bytes.Equal(got, nonce) {
+		t.Fatalf("request nonce = %x, want %x", got, nonce)
+	}
+	var value []byte
+	if _, err := asn1.Unmarshal(nonce, &value); err != nil || len(value) != nonceSize {
+		t.Fatalf("nonce is %x, want a DER encoded OCTET STRING of %d bytes", nonce, nonceSize)
+	}
+	if request, err := ocsp.ParseRequest(first); err != nil || request.SerialNumber.Cmp(leaf.SerialNumber) != 0 {
+		t.Fatalf("ocsp.ParseRequest() = %v, %v, want the serial number of the leaf", request, err)
+	}
+
+	if _, second, err := addNonce(der); err != nil || bytes.Equal(second, nonce) {
+		t.Fatalf("addNonce() twice = %x, %v, want different nonces", second, err)
+	}
+}
+
+func TestRequestNonce(t *testing.T) {
+	ca, certificate := newTestCertificate(t)
+
+	tests := []struct {
+		name    string
+		echo    func(nonce []byte) []byte
+		lenient bool
+		wantErr error
+	}{
+		{"echoed", func(nonce []byte) []byte { return nonce }, false, nil},
+		{"missing", func([]byte) []byte { return nil }, false, ErrOCSPNonceMismatch},
+		{"missing, lenient", func([]byte) []byte { return nil }, true, nil},
+		{"different", func([]byte) []byte { return []byte{0x04, 0x01, 0x00} }, false, ErrOCSPNonceMismatch},
+		{"different, lenient", func([]byte) []byte { return []byte{0x04, 0x01, 0x00} }, true, ErrOCSPNonceMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+				body, err := io.ReadAll(r.Body)
+				if err != nil {
+					return nil, err
+				}
+				nonce := requestNonce(t, body)
+				if nonce == nil {
+					t.Error("request has no nonce")
+				}
+				r.Body = io.NopCloser(bytes.NewReader(body))
+				response, err := ca.respond(t, r, time.Now())
+				if err != nil {
+					return nil, err
+				}
+				raw, err := io.ReadAll(response.Body)
+				if err != nil {
+					return nil, err
+				}
+				if echoed := tt.echo(nonce); echoed != nil {
+					raw = ca.addResponseNonce(t, raw, echoed)
+				}
+				response.Body = io.NopCloser(bytes.NewReader(raw))
+				return response, nil
+			})
+
+			cfg := newConfig([]Option{WithTransport(transport), WithRequestNonce(true), WithLenientNonce(tt.lenient)})
+			if _, err := fetchOCSP(context.Background(), certificate, cfg.newHTTPClient(), &cfg); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("fetchOCSP() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -5,10 +5,15 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
+	"fmt"
 	"golang.org/x/crypto/ocsp"
-	"io"
+	"math"
+	"math/big"
+	"math/rand"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,62 +21,275 @@ import (
 // https://www.ssl.com/article/page-load-optimization-ocsp-stapling/
 
 const (
-	retry = 10
+	// defaultRetries is the default number of retries after a retryable fetch error, see WithMaxRetries. With the first
+	// attempt, creation makes 10 attempts in total.
+	defaultRetries = 9
+	// renewalOverdueGrace is how long a scheduled renewal may be late before RenewalOverdue reports it
+	renewalOverdueGrace = 5 * time.Minute
 )
 
 type Stapling struct {
 	certificate tls.Certificate
 
 	useOCSPStapling bool
+	// thisUpdate and nextUpdate are the ThisUpdate and NextUpdate times of the OCSP response currently stapled to certificate
+	thisUpdate time.Time
+	nextUpdate time.Time
+	// nextRenewal is the time the renewal loop is scheduled to fetch a new OCSP response
+	nextRenewal time.Time
+	// lastRenewal is the time a fetched OCSP response was last installed
+	lastRenewal time.Time
+	// installedAt is the time the current staple was installed, regardless of its source
+	installedAt time.Time
+	// renewalInterval is the most recently computed delay until the next renewal, excluding retries
+	renewalInterval time.Duration
+	// renewalCount is the number of staples installed since start
+	renewalCount atomic.Uint64
+	// lastSuccess is the time in unix nanoseconds the last successful fetch completed
+	lastSuccess atomic.Int64
+	// cacheHits and cacheMisses count the loads from the store that did and didn't provide a valid staple
+	cacheHits   atomic.Uint64
+	cacheMisses atomic.Uint64
+	// lastFetchInfo describes the last successful fetch
+	lastFetchInfo FetchInfo
+	// errorHistory holds the most recent renewal errors
+	errorHistory errorHistory
+	// expiredNotified is set once EventStapleExpired was emitted for the current staple
+	expiredNotified bool
+	// stapleSerial is the certificate serial number the current staple is for
+	stapleSerial *big.Int
+	// stapleSource is where the current staple came from
+	stapleSource Source
+	// stapleStatus is the certificate status of the current staple
+	stapleStatus int
+	// stapleResponse is the parsed OCSP response of the current staple, nil when none was installed
+	stapleResponse *ocsp.Response
+	// minStapleSize and maxStapleSize are the smallest and largest size in bytes of the staples installed since start
+	minStapleSize int
+	maxStapleSize int
+	// revocation holds the details of the last revoked response, if any
+	revocation *revocationInfo
+	// status is the certificate status of the last received response, statusKnown is set once a response was received
+	status      int
+	statusKnown bool
+	// paused stops the renewal loop from fetching
+	paused bool
+	// reschedule wakes up the renewal loop to reschedule based on the current staple, e.g. when it is resumed
+	reschedule chan struct{}
+	// fastForward makes the renewal loop fire its timer immediately, see Testing
+	fastForward chan struct{}
+	// stopped is closed by Stop to end the renewal loop
+	stopped  chan struct{}
+	stopOnce sync.Once
+
+	// saveLock serializes saving staples to the OCSPStore
+	saveLock sync.Mutex
+	// publishLock serializes publishing staples to the staple sink
+	publishLock sync.Mutex
+
+	// renewCall is the ForceRenew fetch in flight, shared by all concurrent ForceRenew calls. A Stapling holds a single
+	// certificate, so a single slot is sufficient to coalesce the calls.
+	renewCall *renewCall
+	renewLock sync.Mutex
+
+	events       chan Event
+	eventsClosed bool
+	eventsLock   sync.Mutex
 
 	httpClient *http.Client
 
+	config config
+
 	lock sync.RWMutex
 }
 
+// Source describes where the current staple came from
+type Source int
+
+const (
+	// SourceNone means no staple was installed yet
+	SourceNone Source = iota
+	// SourceNetwork means the staple was fetched from the OCSP responder
+	SourceNetwork
+	// SourceImported means the staple was imported with SetStaple
+	SourceImported
+	// SourceCache means the staple was loaded from the OCSPStore on startup
+	SourceCache
+)
+
+func (s Source) String() string {
+	switch s {
+	case SourceNone:
+		return "none"
+	case SourceNetwork:
+		return "network"
+	case SourceImported:
+		return "imported"
+	case SourceCache:
+		return "cache"
+	default:
+		return "unknown source"
+	}
+}
+
+// revocationInfo holds the revocation details of a revoked response
+type revocationInfo struct {
+	revokedAt time.Time
+	reason    int
+}
+
+// renewCall is a ForceRenew fetch in flight. err is set before done is closed.
+type renewCall struct {
+	done chan struct{}
+	err  error
+}
+
 // ocspStaplingCanBeUsed is a helper function to check if the certificate has a valid issuer that can return an OCSP response
-// i.e. self-signed certificates won't have such an issuer field
-func ocspStaplingCanBeUsed(ctx context.Context, certificate tls.Certificate) bool {
-	client := &http.Client{}
+// i.e. self-signed certificates won't have such an issuer field. It returns the reason why OCSP stapling can't be used, or nil.
+func ocspStaplingCanBeUsed(ctx context.Context, certificate tls.Certificate, cfg *config) error {
+	client := cfg.newHTTPClient()
 
 	retryTimer := time.NewTimer(time.Millisecond)
 	defer retryTimer.Stop()
 
-	// Retry in case of connectivity issues
-	for i := 0; i < retry; i++ {
+	// Retry in case of temporary issues, the first attempt isn't a retry
+	backoff := Backoff{Base: time.Second}
+	if cfg.backoff != nil {
+		backoff = *cfg.backoff
+	}
+	var err error
+	for i := 0; i <= cfg.maxRetries; i++ {
 		select {
 		case <-ctx.Done():
-			return false
+			return ctx.Err()
 		case <-retryTimer.C:
-			_, _, err := fetchOCSP(certificate, client)
-			if err == nil {
-				return true
-			}
-			if err != ErrCouldNotPostOCSPRequest {
-				return false
+			_, err = fetchOCSP(ctx, certificate, client, cfg)
+			if err == nil || !isRetryable(err) {
+				return err
 			}
 			// Increase delay between subsequent requests
-			retryTimer.Reset(time.Second * time.Duration(i+1))
+			retryTimer.Reset(backoff.delay(i + 1))
 		}
 	}
 
-	return false
+	return err
+}
+
+// fatalErrors are caused by the certificate or the configuration, retrying won't resolve them
+var fatalErrors = []error{
+	ErrInvalidCertificate, ErrNoOCSPServerDefined, ErrIssuerMismatch, ErrMissingIssuer, ErrIssuerNotFound, ErrAmbiguousLeaf,
+	ErrCertificateNotTimeValid, ErrMissingSCT, ErrResponderNotAllowed, ErrCouldNotCreateOCSPRequest, ErrRequestSigningFailed,
+}
+
+// isRetryable reports whether the error may be caused by a temporary issue and the fetch should be retried. Besides
+// connectivity problems, this includes failures reading or parsing a response, as a single garbled response shouldn't
+// disable stapling. Only fatal errors and HTTP client errors other than 429 aren't retried.
+func isRetryable(err error) bool {
+	var fetchErr *FetchError
+	if errors.As(err, &fetchErr) {
+		// Retry when any of the responders may succeed next time
+		for _, attempt := range fetchErr.Attempts {
+			if isRetryable(attempt.Err) {
+				return true
+			}
+		}
+		return false
+	}
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.temporary()
+	}
+	for _, fatal := range fatalErrors {
+		if errors.Is(err, fatal) {
+			return false
+		}
+	}
+	return true
 }
 
 // NewStapling creates a new Stapling struct. The context is provided for early cancellation. The certificate is stored inside the Stapling struct.
 // Certificate with the OCSP staple included can be retrieved by using the stapling.Certificate() method.
-func NewStapling(ctx context.Context, certificate tls.Certificate) *Stapling {
-	return &Stapling{
-		certificate:     certificate,
-		useOCSPStapling: ocspStaplingCanBeUsed(ctx, certificate),
-		httpClient:      &http.Client{},
+// Optional behaviour can be configured by passing one or more Option values.
+// When OCSP stapling can't be used for the certificate, stapling is disabled, use NewStaplingE to find out why.
+func NewStapling(ctx context.Context, certificate tls.Certificate, opts ...Option) *Stapling {
+	s, _ := NewStaplingE(ctx, certificate, opts...)
+	return s
+}
+
+// NewStaplingE creates a new Stapling struct like NewStapling, and returns the reason why OCSP stapling can't be used for
+// the certificate, e.g. ErrNoOCSPServerDefined for a certificate without OCSP server, or ErrCouldNotPostOCSPRequest when the
+// responder is unreachable. The Stapling is returned even when the error is non-nil, stapling is then disabled. With
+// WithAllowNoOCSP, a certificate without OCSP server is not an error. Invalid options fail with ErrInvalidOption before the
+// responder is contacted.
+func NewStaplingE(ctx context.Context, certificate tls.Certificate, opts ...Option) (*Stapling, error) {
+	cfg := newConfig(opts)
+	errorHistorySize := defaultErrorHistory
+	if cfg.errorHistory != nil {
+		errorHistorySize = *cfg.errorHistory
+	}
+	s := &Stapling{
+		certificate:  certificate,
+		httpClient:   cfg.newHTTPClient(),
+		config:       cfg,
+		reschedule:   make(chan struct{}, 1),
+		fastForward:  make(chan struct{}, 1),
+		stopped:      make(chan struct{}),
+		errorHistory: errorHistory{errors: make([]TimedError, errorHistorySize)},
+		events:       make(chan Event, eventBufferSize),
+	}
+	if cfg.err != nil {
+		return s, cfg.err
+	}
+	if s.loadFromStore() {
+		// A valid stored staple proves OCSP stapling can be used, don't contact the responder on startup
+		s.useOCSPStapling = true
+		return s, nil
 	}
+	err := ocspStaplingCanBeUsed(ctx, certificate, &s.config)
+	s.useOCSPStapling = err == nil
+	if errors.Is(err, ErrNoOCSPServerDefined) && s.config.allowNoOCSP {
+		// Intentionally without OCSP, served without staple
+		return s, nil
+	}
+	return s, err
+}
+
+// HasOCSP reports whether an OCSP responder is known for the certificate, either from the certificate itself or from the
+// options. Certificates without responder are served without staple, see WithAllowNoOCSP.
+func (s *Stapling) HasOCSP() bool {
+	s.lock.RLock()
+	certificate := s.certificate
+	s.lock.RUnlock()
+
+	x509Cert, x509Issuer, err := parseChain(certificate, &s.config)
+	if err != nil {
+		return false
+	}
+	return len(s.config.responders(x509Cert, x509Issuer)) > 0
 }
 
-// RunOCSPRenewal will run for-ever until ctx is cancelled. This function renews the OCSP staple in the internal certificate
-// Every time the OCSP issuer server indicates the staple should be refreshed.
+// RunOCSPRenewal will run for-ever until ctx is cancelled or Stop is called. This function renews the OCSP staple in the internal certificate
+// Every time the OCSP issuer server indicates the staple should be refreshed. The requests to the responder are made with ctx,
+// so its values (e.g. a request ID) are available to the HTTP client.
 func (s *Stapling) RunOCSPRenewal(ctx context.Context) {
-	if !s.useOCSPStapling {
+	defer s.closeEvents()
+	defer s.emit(Event{Type: EventStateChanged, State: StateStopped})
+
+	// Stop cancels the loop's context, which also aborts a fetch in flight
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-s.stopped:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	s.lock.RLock()
+	useOCSPStapling := s.useOCSPStapling
+	s.lock.RUnlock()
+	if !useOCSPStapling && !s.rediscover(ctx) {
 		// RunOCSPRenewal was called without OCSP stapling supported certificate
 		return
 	}
@@ -82,110 +300,853 @@ func (s *Stapling) RunOCSPRenewal(ctx context.Context) {
 
 	errorCount := 0
 
+	// With WithPrefetch, the next response is fetched ahead of the renewal instant into staged, and installed at swapAt
+	var staged *fetchResult
+	var swapAt time.Time
+	// scheduleAt resets the timer for a renewal at renewAt, or for the prefetch before it. The caller must hold the lock.
+	scheduleAt := func(renewAt time.Time, reason string) {
+		s.renewalInterval = time.Until(renewAt)
+		if s.config.prefetch > 0 {
+			swapAt = renewAt
+			renewAt = renewAt.Add(-s.config.prefetch)
+			reason += ", minus prefetch lead"
+		}
+		s.scheduleRenewal(timer, time.Until(renewAt), reason)
+	}
+
+	s.lock.Lock()
+	if s.hasValidStaple() {
+		// A staple was installed before the loop started, e.g. by RefreshNow, so don't fetch again right away
+		scheduleAt(s.config.renewalDecision(time.Now(), s.stapleResponse))
+	} else {
+		s.scheduleRenewal(timer, time.Second, "initial fetch")
+	}
+	s.lock.Unlock()
+
 	for {
 		select {
 		case <-ctx.Done():
 			// Shutting down
 			return
-		case <-timer.C:
-			// Renew certificate
+		case <-s.fastForward:
+			// Fire the timer now, the renewal is handled as if it was due
+			s.lock.Lock()
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			s.scheduleRenewal(timer, 0, "fast-forwarded")
+			s.lock.Unlock()
+		case <-s.reschedule:
+			// Reschedule based on the current staple, fetch immediately when there is no valid staple
 			s.lock.Lock()
+			if !timer.Stop() {
+				// Drain the timer if it fired while paused
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			staged = nil
+			if s.hasValidStaple() {
+				scheduleAt(s.config.renewalDecision(time.Now(), s.stapleResponse))
+			} else {
+				s.scheduleRenewal(timer, 0, "rescheduled without a valid staple")
+			}
+			s.lock.Unlock()
+		case <-timer.C:
+			s.lock.RLock()
+			paused := s.paused
+			s.lock.RUnlock()
+			if paused {
+				// Keep serving the current staple, the loop is rescheduled on Resume
+				continue
+			}
+			s.checkExpired()
+
+			if staged != nil {
+				// The prefetched response is installed at the renewal instant, unless a newer staple was installed in
+				// the meantime, e.g. by ForceRenew or SetStaple
+				s.lock.Lock()
+				if s.stapleResponse != nil && staged.response.ThisUpdate.Before(s.stapleResponse.ThisUpdate) {
+					scheduleAt(s.config.renewalDecision(time.Now(), s.stapleResponse))
+				} else {
+					renewAt, reason := s.installFetchResult(staged)
+					scheduleAt(renewAt, "installed prefetched response, "+reason)
+				}
+				staged = nil
+				s.lock.Unlock()
+				continue
+			}
+
+			// Renew certificate. The fetch happens without holding the lock, so a slow responder doesn't block
+			// handshakes or accessors like RenewalOverdue
+			result, err := s.fetch(ctx)
 
-			resp, renewAt, err := fetchOCSP(s.certificate, s.httpClient)
+			s.lock.Lock()
 			if err != nil {
-				switch err {
-				case ErrCouldNotPostOCSPRequest:
-					s.lock.Unlock()
-					// Connectivity issues might cause this error to occur, so retry in a minute.
-					// If the errorCount is bigger than the retry count, we should stop trying
-					if errorCount > retry {
-						return
+				s.errorHistory.add(time.Now(), err)
+				s.emit(Event{Type: EventFetchFailed, Err: err})
+				stop := false
+				switch {
+				case errors.Is(err, ErrByteBudgetExceeded):
+					// Not a failure of the responder, back off until the budget is available again
+					_, resetAt := s.config.byteBudget.exhausted(time.Now())
+					s.scheduleRenewal(timer, time.Until(resetAt), "byte budget exceeded, wait for the window to reset")
+					s.config.logger.Warn("ocspstapling: OCSP byte budget exhausted, postponing renewal", "retryAt", resetAt)
+				case isRetryable(err):
+					// A temporary issue might cause this error to occur, so retry when the scheduler says so.
+					// Once all retries failed, we should stop trying
+					if errorCount >= s.config.maxRetries {
+						s.config.logger.Error("ocspstapling: giving up renewing the OCSP staple",
+							"retries", errorCount, "error", err)
+						stop = true
+						break
 					}
 					errorCount++
-					timer.Reset(time.Minute)
-					continue
+					delay, reason := s.config.decide(s.stapleResponse, err, errorCount, time.Now())
+					s.scheduleRenewal(timer, delay, fmt.Sprintf("retry %d after %v, %s", errorCount, err, reason))
+					s.config.logger.Warn("ocspstapling: OCSP fetch failed, retrying",
+						"attempt", errorCount, "maxRetries", s.config.maxRetries, "retryAt", s.nextRenewal, "error", err)
 				default:
 					// In all other cases the configuration was incorrect, and we should not have been using OCSP Stapling
 					s.useOCSPStapling = false
+					s.emit(Event{Type: EventStateChanged, State: StateDisabled})
+					s.config.logger.Error("ocspstapling: OCSP stapling disabled", "error", err)
+					stop = true
+				}
+				renewal := s.renewalResult(nil, err)
+				s.lock.Unlock()
+				s.notifyRenewal(renewal)
+				if stop {
+					if !s.rediscover(ctx) {
+						return
+					}
+					// Stapling works again, continue renewing based on the rediscovered staple
+					s.lock.Lock()
+					errorCount = 0
+					scheduleAt(s.config.renewalDecision(time.Now(), s.stapleResponse))
 					s.lock.Unlock()
-					return
 				}
+				continue
 			}
 
-			// Set the OCSPStaple to the raw OCSP response from the issuer
-			s.certificate.OCSPStaple = resp
 			// Reset the errorCount to 0 when fetching the data was successful
 			errorCount = 0
-			// renewAt is the time when the issuer of the certificate will renew the OCSP data.
-			// At that time we need to fetch the new OCSP data.
-			// Reset the timer to fire again when the OCSP cache has elapsed
-			timer.Reset(time.Until(renewAt))
+			// ctx isn't consulted from here on: when it is cancelled after a successful fetch, the staple is still
+			// installed, or staged with WithPrefetch, before the loop observes the cancellation and exits
+			s.recordFetchResult(result)
+			if s.config.prefetch > 0 && time.Now().Before(swapAt) {
+				// Prefetched, keep the response staged until the renewal instant
+				staged = result
+				s.scheduleRenewal(timer, time.Until(swapAt), "prefetched, install at the renewal instant")
+			} else {
+				// Reset the timer to fire again when the OCSP cache has elapsed
+				renewAt, reason := s.installFetchResult(result)
+				if !renewAt.After(time.Now()) {
+					// The fresh response is already due for renewal, e.g. it has no NextUpdate or the responder serves
+					// aged responses. Fetching again right away would hammer the responder, so retry later instead.
+					renewAt = time.Now().Add(retryDelay)
+					reason = "fresh response already due (" + reason + "), retry delay"
+				}
+				scheduleAt(renewAt, reason)
+			}
+			renewal := s.renewalResult(result, nil)
+			s.lock.Unlock()
+			s.notifyRenewal(renewal)
+		}
+	}
+}
+
+// rediscover periodically retries fetching after the renewal loop gave up, when configured with WithRediscoveryInterval.
+// Once a fetch succeeds, stapling is enabled again and the staple is installed. It reports false when rediscovery isn't
+// configured or ctx is done first.
+func (s *Stapling) rediscover(ctx context.Context) bool {
+	if s.config.rediscoveryInterval <= 0 {
+		return false
+	}
+	// Spread the probes of many instances, +/- 10% of the interval
+	jittered := func() time.Duration {
+		return time.Duration(float64(s.config.rediscoveryInterval) * (0.9 + 0.2*rand.Float64()))
+	}
+	timer := time.NewTimer(jittered())
+	defer timer.Stop()
 
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-timer.C:
+		}
+		if s.Paused() {
+			timer.Reset(jittered())
+			continue
+		}
+
+		result, err := s.fetch(ctx)
+		s.lock.Lock()
+		if err != nil {
+			s.errorHistory.add(time.Now(), err)
+			s.emit(Event{Type: EventFetchFailed, Err: err})
+			renewal := s.renewalResult(nil, err)
 			s.lock.Unlock()
+			s.notifyRenewal(renewal)
+			timer.Reset(jittered())
+			continue
 		}
+		s.useOCSPStapling = true
+		s.emit(Event{Type: EventStateChanged, State: StateActive})
+		s.config.logger.Info("ocspstapling: OCSP stapling enabled again")
+		s.applyFetchResult(result)
+		renewal := s.renewalResult(result, nil)
+		s.lock.Unlock()
+		s.notifyRenewal(renewal)
+		return true
+	}
+}
+
+// Stop ends the renewal loop without cancelling the context passed to RunOCSPRenewal, e.g. when the certificate is rotated
+// out. A fetch in flight is aborted and RunOCSPRenewal returns, or returns immediately when it is called after Stop. The
+// current staple keeps being served. Stop may be called multiple times, also when the renewal loop was never started.
+func (s *Stapling) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stopped)
+	})
+}
+
+// applyFetchResult records a successful fetch and installs the fetched staple. It returns the time at which the next
+// renewal should happen, and the reason for it. The caller must hold the lock.
+func (s *Stapling) applyFetchResult(result *fetchResult) (time.Time, string) {
+	s.recordFetchResult(result)
+	return s.installFetchResult(result)
+}
+
+// recordFetchResult records a successful fetch. The caller must hold the lock.
+func (s *Stapling) recordFetchResult(result *fetchResult) {
+	s.lastSuccess.Store(time.Now().UnixNano())
+	s.lastFetchInfo = result.info
+	s.emit(Event{Type: EventFetchSucceeded, NextUpdate: result.response.NextUpdate})
+	if !s.replacedDuringFetch(result) {
+		s.recordStatus(result.response)
+	}
+}
+
+// replacedDuringFetch reports whether the certificate was replaced with SetCertificate after result was fetched for the
+// previous one. The caller must hold the lock.
+func (s *Stapling) replacedDuringFetch(result *fetchResult) bool {
+	return result.leaf != nil && !bytes.Equal(result.leaf, s.certificate.Certificate[0])
+}
+
+// installFetchResult installs the fetched staple. It returns the time at which the next renewal should happen, and the
+// reason for it. The caller must hold the lock.
+func (s *Stapling) installFetchResult(result *fetchResult) (time.Time, string) {
+	response := result.response
+
+	if s.replacedDuringFetch(result) {
+		// SetCertificate already woke up the renewal loop to fetch for the new certificate
+		return time.Now(), "certificate replaced during the fetch"
+	}
+	if s.config.keepLongestValidity && s.hasValidStaple() && !response.NextUpdate.After(s.nextUpdate) {
+		// The current staple is valid for longer than the new response, keep serving it and
+		// schedule the next fetch based on the current staple
+		renewAt, reason := s.config.renewalDecision(time.Now(), s.stapleResponse)
+		return renewAt, "kept the longer valid staple, " + reason
+	}
+
+	// Set the OCSPStaple to the raw OCSP response from the issuer
+	s.installStaple(result.raw, response, SourceNetwork)
+	s.lastRenewal = time.Now()
+	// The scheduler decides when the new OCSP data needs to be fetched, unless the responder wants to be asked again sooner
+	renewAt, reason := s.config.renewalDecision(time.Now(), response)
+	if !result.cacheExpiry.IsZero() && result.cacheExpiry.Before(renewAt) {
+		renewAt, reason = result.cacheExpiry, "HTTP cache expiry, before "+reason
+	}
+	s.config.logger.Info("ocspstapling: OCSP staple renewed",
+		"responder", result.info.Responder, "nextUpdate", response.NextUpdate, "renewAt", renewAt)
+	return renewAt, reason
+}
+
+// ForceRenew fetches a new OCSP response and installs it immediately, independent of the renewal loop. Concurrent calls
+// share a single in-flight fetch and all receive its result, so a burst of calls contacts the responder only once.
+// ctx only bounds how long the caller waits for the result.
+func (s *Stapling) ForceRenew(ctx context.Context) error {
+	// The fetch is shared, so it must not be cancelled when this caller gives up. The values of ctx are kept.
+	return s.sharedRenew(ctx, context.WithoutCancel(ctx))
+}
+
+// sharedRenew joins the ForceRenew fetch in flight, or starts one with fetchCtx, and waits for its result until ctx is done
+func (s *Stapling) sharedRenew(ctx, fetchCtx context.Context) error {
+	s.renewLock.Lock()
+	call := s.renewCall
+	if call == nil {
+		// No fetch in flight, start one which is shared with the calls arriving while it runs
+		call = &renewCall{done: make(chan struct{})}
+		s.renewCall = call
+		go s.forceRenew(fetchCtx, call)
+	}
+	s.renewLock.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-call.done:
+		return call.err
+	}
+}
+
+// fetch fetches a new OCSP response for the current certificate. It must be called without holding the lock.
+func (s *Stapling) fetch(ctx context.Context) (*fetchResult, error) {
+	s.lock.RLock()
+	certificate := s.certificate
+	current := s.stapleResponse
+	s.lock.RUnlock()
+
+	result, err := fetchOCSP(ctx, certificate, s.httpClient, &s.config)
+	if err != nil {
+		return nil, err
+	}
+	result.leaf = certificate.Certificate[0]
+	if s.config.rejectStaleResponses && current != nil && result.response.ThisUpdate.Before(current.ThisUpdate) {
+		// A lagging responder or cache returned an older response than the one already stapled
+		return nil, ErrStaleResponse
+	}
+	return result, nil
+}
+
+// forceRenew performs the fetch of a ForceRenew call and publishes the result to all waiting callers
+func (s *Stapling) forceRenew(ctx context.Context, call *renewCall) {
+	result, err := s.fetch(ctx)
+	s.lock.Lock()
+	if err != nil {
+		s.errorHistory.add(time.Now(), err)
+		s.emit(Event{Type: EventFetchFailed, Err: err})
+	} else {
+		s.applyFetchResult(result)
+	}
+	renewal := s.renewalResult(result, err)
+	s.lock.Unlock()
+	s.notifyRenewal(renewal)
+	if err == nil {
+		// Drop a response the renewal loop prefetched before this one, and reschedule based on the new staple
+		s.wakeRenewalLoop()
 	}
+
+	s.renewLock.Lock()
+	s.renewCall = nil
+	s.renewLock.Unlock()
+
+	call.err = err
+	close(call.done)
 }
 
-// Certificate returns a copy of the internal certificate as a pointer. At the moment error is always nil, but included to satisfy the GetCertificate
-// function from tls.Config return value
+// RefreshNow fetches a new OCSP response and installs it before returning, e.g. to make sure the very first handshake is
+// stapled by calling it before the server starts accepting connections. The error of the fetch is returned directly.
+// A running renewal loop schedules its next fetch relative to the installed staple, and a renewal loop started afterwards
+// doesn't fetch again until the staple is due for renewal.
+func (s *Stapling) RefreshNow(ctx context.Context) error {
+	result, err := s.fetch(ctx)
+	s.lock.Lock()
+	if err != nil {
+		s.errorHistory.add(time.Now(), err)
+		s.emit(Event{Type: EventFetchFailed, Err: err})
+		renewal := s.renewalResult(nil, err)
+		s.lock.Unlock()
+		s.notifyRenewal(renewal)
+		return err
+	}
+	// The next renewal is scheduled by the renewal loop, if running, which is woken below
+	renewAt, _ := s.applyFetchResult(result)
+	s.renewalInterval = time.Until(renewAt)
+	renewal := s.renewalResult(result, nil)
+	s.lock.Unlock()
+	s.notifyRenewal(renewal)
+
+	s.wakeRenewalLoop()
+	return nil
+}
+
+// scheduleRenewal resets the renewal timer to fire after d and records when that is. The decision is logged at debug level
+// together with the reason, so the renewal cadence can be audited. The caller must hold the lock.
+func (s *Stapling) scheduleRenewal(timer *time.Timer, d time.Duration, reason string) {
+	timer.Reset(d)
+	s.nextRenewal = time.Now().Add(d)
+
+	var thisUpdate, nextUpdate time.Time
+	if s.stapleResponse != nil {
+		thisUpdate, nextUpdate = s.stapleResponse.ThisUpdate, s.stapleResponse.NextUpdate
+	}
+	s.config.logger.Debug("ocspstapling: renewal scheduled",
+		"at", s.nextRenewal, "delay", d, "reason", reason,
+		"thisUpdate", thisUpdate, "nextUpdate", nextUpdate,
+		"scheduler", fmt.Sprintf("%T", s.config.scheduler), "prefetch", s.config.prefetch,
+		"keepLongestValidity", s.config.keepLongestValidity)
+}
+
+// EffectiveRenewalInterval returns the most recently computed delay between installing a staple and renewing it, taking
+// all scheduling options into account. Retries after failed fetches are not included. It returns 0 until the renewal loop
+// installed a staple.
+func (s *Stapling) EffectiveRenewalInterval() time.Duration {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.renewalInterval
+}
+
+// NextRenewal returns the time the next fetch is scheduled, including retries after failed fetches, or the zero time when
+// the renewal loop has not been started. A time in the past indicates the renewal loop may be stuck, see RenewalOverdue.
+func (s *Stapling) NextRenewal() time.Time {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.nextRenewal
+}
+
+// LastRenewal returns the time a fetched OCSP response was last installed, or the zero time when none was installed yet.
+// Unlike LastSuccess it doesn't advance when the fetched response isn't installed, see WithKeepLongestValidity.
+func (s *Stapling) LastRenewal() time.Time {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.lastRenewal
+}
+
+// InstalledAt returns the time the currently served staple was installed, or the zero time when there is no staple. Unlike
+// LastRenewal it includes staples imported with SetStaple or loaded from the store, and unlike LastSuccess it doesn't
+// advance when a fetched response isn't installed.
+func (s *Stapling) InstalledAt() time.Time {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.installedAt
+}
+
+// RenewalOverdue reports whether the scheduled renewal is more than a grace margin in the past. This indicates the renewal
+// loop may be stuck, e.g. on a hung fetch, and is silently serving an ageing staple. A paused renewal loop is never overdue,
+// it reschedules on Resume.
+func (s *Stapling) RenewalOverdue() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.nextRenewal.IsZero() || s.paused {
+		// The renewal loop has not been started, or doesn't renew until resumed
+		return false
+	}
+	return time.Since(s.nextRenewal) > renewalOverdueGrace
+}
+
+// Certificate returns a copy of the internal certificate as a pointer. At the moment error is always nil, but included to
+// match the return value of the GetCertificate function from tls.Config, see GetCertificate.
+// The OCSPStaple of the returned certificate is served by crypto/tls in both TLS 1.2 (CertificateStatus message) and TLS 1.3
+// (status_request extension of the leaf's CertificateEntry) whenever the client requests stapling, no extra wiring is needed.
 func (s *Stapling) Certificate() (*tls.Certificate, error) {
 	s.lock.RLock()
 	certificate := s.certificate
+	servable := s.servableStaple()
+	stapleSerial := s.stapleSerial
 	s.lock.RUnlock()
+
+	if !servable {
+		// Don't staple a response that expired beyond the grace period, clients would reject it
+		certificate.OCSPStaple = nil
+	} else if s.config.checkStapleOnServe && !stapleMatchesLeaf(certificate, stapleSerial) {
+		// Clients reject a staple for another certificate, serving none is better
+		s.config.logger.Warn("ocspstapling: not serving OCSP staple", "error", ErrStapleKeyMismatch)
+		certificate.OCSPStaple = nil
+	}
 	return &certificate, nil
 }
 
-// fetchOCSP uses the certificate and httpClient to get a raw response from the Certificate issuer.
-// returns the raw response, the NextUpdate time (for renewal) or an error in case something went wrong.
-func fetchOCSP(certificate tls.Certificate, httpClient *http.Client) ([]byte, time.Time, error) {
-	// Owner Certificate should be index 0 in chain
-	x509Cert, err := x509.ParseCertificate(certificate.Certificate[0])
-	if err != nil {
-		return nil, time.Time{}, ErrInvalidCertificate
+// stapleMatchesLeaf reports whether the staple for stapleSerial belongs to the leaf of the certificate
+func stapleMatchesLeaf(certificate tls.Certificate, stapleSerial *big.Int) bool {
+	leaf := certificate.Leaf
+	if leaf == nil {
+		if len(certificate.Certificate) == 0 {
+			return false
+		}
+		var err error
+		if leaf, err = x509.ParseCertificate(certificate.Certificate[0]); err != nil {
+			return false
+		}
+	}
+	return stapleSerial != nil && leaf.SerialNumber.Cmp(stapleSerial) == 0
+}
+
+// GetCertificate returns the stapled copy of the internal certificate like Certificate, it can be assigned directly to
+// tls.Config.GetCertificate. The ClientHello is ignored, since a Stapling holds a single certificate.
+func (s *Stapling) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.Certificate()
+}
+
+// GetClientCertificate returns a copy of the internal certificate, it can be assigned to tls.Config.GetClientCertificate so the
+// same managed certificate can be used as client certificate for mutual TLS. OCSP staples aren't used client side.
+func (s *Stapling) GetClientCertificate(_ *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return s.Certificate()
+}
+
+// BareCertificate returns a copy of the internal certificate without the OCSP staple, e.g. for computing fingerprints.
+// The DER encoded chain is copied as well, so the caller may modify it freely. The private key is shared.
+func (s *Stapling) BareCertificate() *tls.Certificate {
+	s.lock.RLock()
+	certificate := s.certificate
+	s.lock.RUnlock()
+
+	chain := make([][]byte, len(certificate.Certificate))
+	for i, der := range certificate.Certificate {
+		chain[i] = append([]byte(nil), der...)
 	}
-	if len(x509Cert.OCSPServer) == 0 {
-		// If there are no OCSPServers defined in the certificate, just return the TLS certificate as is.
-		return nil, time.Time{}, ErrNoOCSPServerDefined
+	certificate.Certificate = chain
+	certificate.OCSPStaple = nil
+	return &certificate
+}
+
+// ApplyTo copies the current OCSP staple into the OCSPStaple field of the provided certificate. This is useful when the caller
+// owns the tls.Certificate and only wants this package to keep the staple fresh. ErrNoValidStaple is returned (and cert is
+// left untouched) when there is no staple or the staple has expired (beyond the grace period of WithExpiredGrace).
+func (s *Stapling) ApplyTo(cert *tls.Certificate) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if !s.servableStaple() {
+		return ErrNoValidStaple
 	}
-	// Get the first OCSPServer. (Let's Encrypt certificates usually only have 1 OCSPServer
-	ocspServer := x509Cert.OCSPServer[0]
 
-	// The second certificate in the chain should be the issuer's certificate
-	if len(certificate.Certificate) <= 1 {
-		return nil, time.Time{}, ErrInvalidCertificate
+	// Copy the staple, so the caller can't modify our internal staple through cert
+	cert.OCSPStaple = append([]byte(nil), s.certificate.OCSPStaple...)
+	return nil
+}
+
+// installStaple sets the raw OCSP response as the staple of the internal certificate. The caller must hold the lock.
+func (s *Stapling) installStaple(raw []byte, response *ocsp.Response, source Source) {
+	s.certificate.OCSPStaple = raw
+	s.thisUpdate = response.ThisUpdate
+	s.nextUpdate = response.NextUpdate
+	s.stapleSerial = response.SerialNumber
+	s.stapleSource = source
+	s.stapleStatus = response.Status
+	s.stapleResponse = response
+	s.installedAt = time.Now()
+	if s.renewalCount.Load() == 0 || len(raw) < s.minStapleSize {
+		s.minStapleSize = len(raw)
 	}
-	x509Issuer, err := x509.ParseCertificate(certificate.Certificate[1])
-	if err != nil {
-		return nil, time.Time{}, ErrInvalidCertificate
+	if len(raw) > s.maxStapleSize {
+		s.maxStapleSize = len(raw)
+	}
+	s.renewalCount.Add(1)
+	s.expiredNotified = false
+	s.emit(Event{Type: EventStapleInstalled, NextUpdate: response.NextUpdate})
+	if s.config.store != nil && source != SourceCache {
+		// Don't block handshakes on the store while the lock is held
+		go s.saveToStore()
+	}
+	if s.config.stapleSink != nil && source == SourceNetwork {
+		go s.publishStaple()
+	}
+}
+
+// checkExpired emits EventStapleExpired once when the installed staple passed its NextUpdate
+func (s *Stapling) checkExpired() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.expiredNotified || len(s.certificate.OCSPStaple) == 0 || s.nextUpdate.IsZero() || time.Now().Before(s.nextUpdate) {
+		return
+	}
+	s.expiredNotified = true
+	s.emit(Event{Type: EventStapleExpired, NextUpdate: s.nextUpdate})
+}
+
+// RenewalCount returns the number of staples successfully installed since the Stapling was created
+func (s *Stapling) RenewalCount() uint64 {
+	return s.renewalCount.Load()
+}
+
+// LastSuccess returns the time the last successful fetch completed, or the zero time when no fetch succeeded yet.
+// Alerting on this catches a wedged renewal loop even while the staple is still valid.
+func (s *Stapling) LastSuccess() time.Time {
+	nanos := s.lastSuccess.Load()
+	if nanos == 0 {
+		return time.Time{}
 	}
+	return time.Unix(0, nanos)
+}
+
+// LastFetchInfo returns details about the last successful fetch, like how long was spent on the network and on parsing
+// and verifying the response. The zero FetchInfo is returned when no fetch succeeded yet.
+func (s *Stapling) LastFetchInfo() FetchInfo {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.lastFetchInfo
+}
+
+// LastResponderAddrs returns the IP addresses the responder host resolved to during the last successful fetch. Addresses are
+// only recorded with WithHTTPTrace, and no addresses are returned when the fetch reused a kept-alive connection.
+func (s *Stapling) LastResponderAddrs() []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return append([]string(nil), s.lastFetchInfo.ResponderAddrs...)
+}
 
-	// Create the OCSP request using the 'Owner certificate' and the 'Issuer certificate'
-	ocspRequest, err := ocsp.CreateRequest(x509Cert, x509Issuer, nil)
+// StapleSize returns the size in bytes of the current staple, 0 when no staple is installed
+func (s *Stapling) StapleSize() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.certificate.OCSPStaple)
+}
+
+// StapleSizeRange returns the smallest and largest size in bytes of the staples installed since start. A sudden change,
+// e.g. when a responder starts embedding certificates, can indicate a configuration change of the responder. Both are 0
+// until a staple was installed.
+func (s *Stapling) StapleSizeRange() (min, max int) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.minStapleSize, s.maxStapleSize
+}
+
+// BytesFetched returns the total number of response bytes read from the responders since start, excluding HTTP headers
+func (s *Stapling) BytesFetched() uint64 {
+	return s.config.bytesFetched.Load()
+}
+
+// RecentErrors returns the most recent renewal errors, oldest first. The number of errors kept is configured with
+// WithErrorHistory. Failed fetches contribute one error per attempted responder.
+func (s *Stapling) RecentErrors() []TimedError {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.errorHistory.list()
+}
+
+// TimeUntilStaplingBreaks returns how long the current staple can still be served if no further fetch succeeds, including the
+// grace period of WithExpiredGrace. It returns 0 when no staple is served anymore, and the maximum duration for a staple
+// without NextUpdate.
+func (s *Stapling) TimeUntilStaplingBreaks() time.Duration {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if !s.servableStaple() {
+		return 0
+	}
+	if s.nextUpdate.IsZero() {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Until(s.nextUpdate.Add(s.config.expiredGrace))
+}
+
+// recordStatus keeps the certificate status of the response, and the revocation details when the response says the
+// certificate is revoked. The caller must hold the lock.
+func (s *Stapling) recordStatus(response *ocsp.Response) {
+	s.status = response.Status
+	s.statusKnown = true
+	if response.Status != ocsp.Revoked {
+		return
+	}
+	s.revocation = &revocationInfo{revokedAt: response.RevokedAt, reason: response.RevocationReason}
+}
+
+// Status returns the certificate status of the last OCSP response that was received: ocsp.Good, ocsp.Revoked or ocsp.Unknown.
+// When the status is ocsp.Revoked, revokedAt is the time of revocation. ocsp.Unknown is also returned when no response was
+// received yet. This allows alerting when the served certificate gets revoked.
+func (s *Stapling) Status() (status int, revokedAt time.Time) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if !s.statusKnown {
+		return ocsp.Unknown, time.Time{}
+	}
+	if s.status == ocsp.Revoked && s.revocation != nil {
+		return s.status, s.revocation.revokedAt
+	}
+	return s.status, time.Time{}
+}
+
+// RevocationInfo returns when and why the certificate was revoked, as reported by the last revoked OCSP response. The reason
+// is one of the ocsp revocation reason codes, like ocsp.KeyCompromise. ok is false when no revoked response was received.
+func (s *Stapling) RevocationInfo() (revokedAt time.Time, reason int, ok bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.revocation == nil {
+		return time.Time{}, 0, false
+	}
+	return s.revocation.revokedAt, s.revocation.reason, true
+}
+
+// AllowlistMisses returns how often a responder that is not on the allowlist of WithResponderAllowlist was encountered,
+// whether it was skipped or, in report-only mode, contacted anyway
+func (s *Stapling) AllowlistMisses() uint64 {
+	return s.config.allowlistMisses.Load()
+}
+
+// StapleSource returns where the current staple came from
+func (s *Stapling) StapleSource() Source {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.stapleSource
+}
+
+// hasValidStaple reports whether a staple is set and has not expired yet. A response without NextUpdate doesn't expire.
+// The caller must hold the lock.
+func (s *Stapling) hasValidStaple() bool {
+	return len(s.certificate.OCSPStaple) != 0 && (s.nextUpdate.IsZero() || time.Now().Before(s.nextUpdate))
+}
+
+// awaitingStaple reports whether OCSP stapling can be used for the certificate, but no staple that may be served is installed
+func (s *Stapling) awaitingStaple() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.useOCSPStapling && !s.servableStaple()
+}
+
+// servableStaple reports whether a staple is set that may be served: it has not expired, or expired less than the grace period
+// configured with WithExpiredGrace ago. A response without NextUpdate doesn't expire. The caller must hold the lock.
+func (s *Stapling) servableStaple() bool {
+	if len(s.certificate.OCSPStaple) == 0 {
+		return false
+	}
+	return s.nextUpdate.IsZero() || time.Now().Before(s.nextUpdate.Add(s.config.expiredGrace))
+}
+
+// SetStaple installs an externally fetched raw OCSP response as the staple of the internal certificate.
+// The response must be signed by the issuer of the certificate. A response whose NextUpdate has already passed is rejected
+// with ErrResponseExpired, unless it expired less than the tolerance configured with WithImportTolerance ago. A response
+// without NextUpdate doesn't expire.
+func (s *Stapling) SetStaple(raw []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	x509Cert, x509Issuer, err := parseChain(s.certificate, &s.config)
 	if err != nil {
-		return nil, time.Time{}, ErrCouldNotCreateOCSPRequest
+		return err
 	}
 
-	// POST the OCSP request to the ocspServer defined in the 'Owner certificate'
-	ocspResponse, err := httpClient.Post(ocspServer, "application/ocsp-request", bytes.NewReader(ocspRequest))
+	response, err := parseResponse(raw, x509Issuer, &s.config)
 	if err != nil {
-		return nil, time.Time{}, ErrCouldNotPostOCSPRequest
+		return err
+	}
+	if response.SerialNumber.Cmp(x509Cert.SerialNumber) != 0 {
+		// The staple is for another certificate of the same issuer, e.g. due to a shared cache mix-up
+		return ErrStapleKeyMismatch
+	}
+	if !response.NextUpdate.IsZero() && time.Now().After(response.NextUpdate.Add(s.config.importTolerance)) {
+		return ErrResponseExpired
 	}
 
-	// Read the ocsp response body
-	ocspResponseData, err := io.ReadAll(ocspResponse.Body)
+	s.recordStatus(response)
+	s.installStaple(append([]byte(nil), raw...), response, SourceImported)
+	s.wakeRenewalLoop()
+	return nil
+}
+
+// ValidateCertificateLocal checks, without any network I/O, that the certificate can be used for OCSP stapling: the leaf
+// parses, the issuer is present in the chain and signed the leaf, and at least one OCSP server is known for the leaf.
+// This separates configuration errors from responder availability.
+func (s *Stapling) ValidateCertificateLocal() error {
+	s.lock.RLock()
+	certificate := s.certificate
+	s.lock.RUnlock()
+
+	return validateChain(certificate, &s.config)
+}
+
+// RefreshIssuer re-runs the detection of the issuer against the current chain, without any network I/O, and reports
+// whether an issuer that signed the leaf is found, e.g. to recover after ErrIssuerMismatch. Every fetch detects the issuer
+// from the current chain, but with WithAIAIssuerFetch a downloaded issuer is cached. RefreshIssuer drops the cached issuer
+// of the leaf, so the next fetch downloads it again when the chain doesn't contain it.
+func (s *Stapling) RefreshIssuer() error {
+	s.lock.RLock()
+	certificate := s.certificate
+	s.lock.RUnlock()
+
+	if s.config.aiaIssuers != nil && len(certificate.Certificate) > 0 {
+		if leaf, err := x509.ParseCertificate(certificate.Certificate[0]); err == nil {
+			s.config.aiaIssuers.forget(leaf)
+		}
+	}
+	x509Cert, x509Issuer, err := parseChain(certificate, &s.config)
+	if errors.Is(err, ErrMissingIssuer) && s.config.aiaIssuers != nil {
+		// The next fetch downloads the issuer
+		return nil
+	}
 	if err != nil {
-		return nil, time.Time{}, ErrCouldNotReadOCSPResponse
+		return err
 	}
+	if err := x509Cert.CheckSignatureFrom(x509Issuer); err != nil {
+		return ErrIssuerMismatch
+	}
+	return nil
+}
 
-	if err := ocspResponse.Body.Close(); err != nil {
-		return ocspResponseData, time.Time{}, ErrCouldNotCloseBody
+// SetCertificate replaces the certificate, e.g. after it was renewed through ACME, without restarting the renewal loop. The
+// staple of the previous certificate is removed, and whether OCSP stapling can be used is re-evaluated locally, see
+// ValidateCertificateLocal. A missing issuer is accepted with WithAIAIssuerFetch, the fetch downloads it. A running
+// renewal loop fetches a staple for the new certificate immediately. A renewal loop that gave up only picks up the new
+// certificate with WithRediscoveryInterval.
+func (s *Stapling) SetCertificate(certificate tls.Certificate) error {
+	if len(certificate.Certificate) == 0 {
+		return ErrInvalidCertificate
 	}
+	// Don't keep a staple that came with the certificate, it is verified when installed with SetStaple
+	certificate.OCSPStaple = nil
+	err := validateChain(certificate, &s.config)
+	// With WithAIAIssuerFetch, the next fetch downloads an issuer that is missing from the chain
+	usable := err == nil || errors.Is(err, ErrMissingIssuer) && s.config.aiaIssuers != nil
 
-	response, err := ocsp.ParseResponse(ocspResponseData, x509Issuer)
-	if err != nil {
-		return nil, time.Time{}, ErrCouldNotParseResponse
+	s.lock.Lock()
+	s.certificate = certificate
+	s.useOCSPStapling = usable
+	s.thisUpdate = time.Time{}
+	s.nextUpdate = time.Time{}
+	s.installedAt = time.Time{}
+	s.stapleSerial = nil
+	s.stapleSource = SourceNone
+	s.stapleStatus = ocsp.Unknown
+	s.stapleResponse = nil
+	s.status = ocsp.Unknown
+	s.statusKnown = false
+	s.revocation = nil
+	s.expiredNotified = false
+	s.lock.Unlock()
+
+	s.wakeRenewalLoop()
+	return nil
+}
+
+// Pause stops the renewal loop from contacting the responder, e.g. during a maintenance window. The last staple keeps being
+// served and the renewal goroutine keeps running.
+func (s *Stapling) Pause() {
+	s.lock.Lock()
+	wasPaused := s.paused
+	s.paused = true
+	s.lock.Unlock()
+
+	if !wasPaused {
+		s.emit(Event{Type: EventStateChanged, State: StatePaused})
 	}
+}
+
+// Resume lets a paused renewal loop fetch again. The next renewal is rescheduled based on the NextUpdate of the current
+// staple, or happens immediately when the current staple has expired.
+func (s *Stapling) Resume() {
+	s.lock.Lock()
+	wasPaused := s.paused
+	s.paused = false
+	s.lock.Unlock()
 
-	// Return the ocsp response data
-	return ocspResponseData, response.NextUpdate, nil
+	if !wasPaused {
+		return
+	}
+	s.emit(Event{Type: EventStateChanged, State: StateActive})
+	s.wakeRenewalLoop()
+}
+
+// wakeRenewalLoop makes the renewal loop reschedule based on the current staple. A pending wake up is sufficient.
+func (s *Stapling) wakeRenewalLoop() {
+	select {
+	case s.reschedule <- struct{}{}:
+	default:
+	}
+}
+
+// Paused reports whether the renewal loop is paused
+func (s *Stapling) Paused() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.paused
 }
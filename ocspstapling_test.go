@@ -0,0 +1,420 @@
+package ocspstapling
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"github.com/rubenwo/ocspstapling/ocspstaplingtest"
+	"math/big"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSetCertificateAcceptsMissingIssuerWithAIA(t *testing.T) {
+	ca := newTestCA(t, "issuer")
+	template := func(serial int64) *x509.Certificate {
+		return &x509.Certificate{
+			SerialNumber:          big.NewInt(serial),
+			Subject:               pkix.Name{CommonName: "leaf"},
+			OCSPServer:            []string{"http://ocsp.example/"},
+			IssuingCertificateURL: []string{"http://ca.example/issuer.der"},
+		}
+	}
+	leaf, key := ca.issue(t, template(42))
+	s, err := NewStaplingE(context.Background(), tls.Certificate{Certificate: [][]byte{leaf.Raw, ca.cert.Raw}, PrivateKey: key},
+		WithTransport(ca.transport(t)), WithAIAIssuerFetch(true))
+	if err != nil {
+		t.Fatalf("NewStaplingE() error = %v", err)
+	}
+
+	renewed, key := ca.issue(t, template(43))
+	if err := s.SetCertificate(tls.Certificate{Certificate: [][]byte{renewed.Raw}, PrivateKey: key}); err != nil {
+		t.Fatalf("SetCertificate() error = %v", err)
+	}
+	s.lock.RLock()
+	usable := s.useOCSPStapling
+	s.lock.RUnlock()
+	if !usable {
+		t.Fatal("SetCertificate() disabled stapling for a leaf whose issuer can be downloaded")
+	}
+	if err := s.RefreshNow(context.Background()); err != nil {
+		t.Fatalf("RefreshNow() error = %v", err)
+	}
+}
+
+func TestRefreshIssuerDropsDownloadedIssuer(t *testing.T) {
+	ca := newTestCA(t, "issuer")
+	certificate := ca.certificate(t, x509.Certificate{IssuingCertificateURL: []string{"http://ca.example/issuer.der"}})
+	certificate.Certificate = certificate.Certificate[:1]
+	var downloads atomic.Int32
+	responder := ca.transport(t)
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if r.Method == http.MethodGet {
+			downloads.Add(1)
+		}
+		return responder(r)
+	})
+	s, err := NewStaplingE(context.Background(), certificate,
+		WithTransport(transport), WithAIAIssuerFetch(true))
+	if err != nil {
+		t.Fatalf("NewStaplingE() error = %v", err)
+	}
+
+	if err := s.RefreshIssuer(); err != nil {
+		t.Fatalf("RefreshIssuer() error = %v", err)
+	}
+	if err := s.RefreshNow(context.Background()); err != nil {
+		t.Fatalf("RefreshNow() error = %v", err)
+	}
+	if got := downloads.Load(); got != 2 {
+		t.Fatalf("issuer downloaded %d times, want 2", got)
+	}
+}
+
+func TestPrefetchedResponseOlderThanForcedRenewalIsDropped(t *testing.T) {
+	ca, certificate := newTestCertificate(t)
+	// The renewal loop receives responses produced a minute ago, the forced renewal a fresh one
+	var requests atomic.Int32
+	var forced atomic.Bool
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		requests.Add(1)
+		if forced.CompareAndSwap(true, false) {
+			return ca.respond(t, r, time.Now())
+		}
+		return ca.respond(t, r, time.Now().Add(-time.Minute))
+	})
+	// The prefetch lead exceeds the renewal time, so every installed staple is followed by a prefetch right away
+	s, err := NewStaplingE(context.Background(), certificate,
+		WithTransport(transport), WithPrefetch(2*time.Hour))
+	if err != nil {
+		t.Fatalf("NewStaplingE() error = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.RunOCSPRenewal(ctx)
+
+	// Wait for the fetch of NewStaplingE, the initial fetch of the loop and the prefetch that follows it
+	eventually(t, func() bool { return requests.Load() >= 3 }, "renewal loop didn't prefetch")
+	forced.Store(true)
+	if err := s.ForceRenew(context.Background()); err != nil {
+		t.Fatalf("ForceRenew() error = %v", err)
+	}
+	s.lock.RLock()
+	want := s.stapleResponse.ThisUpdate
+	s.lock.RUnlock()
+
+	// The forced renewal makes the loop prefetch again. Swap in that response, and wait for the prefetch after it.
+	eventually(t, func() bool { return requests.Load() >= 5 }, "renewal loop didn't prefetch after the forced renewal")
+	s.Testing().FastForward()
+	eventually(t, func() bool { return requests.Load() >= 6 }, "renewal loop didn't prefetch again")
+	s.lock.RLock()
+	got := s.stapleResponse.ThisUpdate
+	s.lock.RUnlock()
+	if !got.Equal(want) {
+		t.Fatalf("staple ThisUpdate = %v, want the forced renewal at %v", got, want)
+	}
+}
+
+func TestHandshakeDeliversStaple(t *testing.T) {
+	responder, err := ocspstaplingtest.NewResponder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer responder.Close()
+	certificate, err := responder.Certificate("example.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewStaplingE(context.Background(), certificate)
+	if err != nil {
+		t.Fatalf("NewStaplingE() error = %v", err)
+	}
+	if err := s.RefreshNow(context.Background()); err != nil {
+		t.Fatalf("RefreshNow() error = %v", err)
+	}
+	served, _ := s.Certificate()
+	roots := x509.NewCertPool()
+	roots.AddCert(responder.Issuer)
+
+	tests := []struct {
+		name    string
+		version uint16
+	}{
+		{"TLS 1.2", tls.VersionTLS12},
+		{"TLS 1.3", tls.VersionTLS13},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverConn, clientConn := net.Pipe()
+			defer serverConn.Close()
+			defer clientConn.Close()
+			server := tls.Server(serverConn, &tls.Config{GetCertificate: s.GetCertificate, MinVersion: tt.version})
+			client := tls.Client(clientConn, &tls.Config{RootCAs: roots, ServerName: "example.test", MaxVersion: tt.version})
+
+			serverErr := make(chan error, 1)
+			go func() {
+				serverErr <- server.Handshake()
+			}()
+			if err := client.Handshake(); err != nil {
+				t.Fatalf("client handshake error = %v", err)
+			}
+			if err := <-serverErr; err != nil {
+				t.Fatalf("server handshake error = %v", err)
+			}
+
+			state := client.ConnectionState()
+			if state.Version != tt.version {
+				t.Fatalf("negotiated version %x, want %x", state.Version, tt.version)
+			}
+			if len(state.OCSPResponse) == 0 || !bytes.Equal(state.OCSPResponse, served.OCSPStaple) {
+				t.Fatalf("client received staple of %d bytes, want the served staple of %d bytes",
+					len(state.OCSPResponse), len(served.OCSPStaple))
+			}
+		})
+	}
+}
+
+func TestContextValuesReachRequests(t *testing.T) {
+	type contextKey struct{}
+	ca, certificate := newTestCertificate(t)
+	var requests, withValue atomic.Int32
+	responder := ca.transport(t)
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		requests.Add(1)
+		if r.Context().Value(contextKey{}) == "request-id" {
+			withValue.Add(1)
+		}
+		return responder(r)
+	})
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), contextKey{}, "request-id"))
+	defer cancel()
+	s, err := NewStaplingE(ctx, certificate,
+		WithTransport(transport))
+	if err != nil {
+		t.Fatalf("NewStaplingE() error = %v", err)
+	}
+	if err := s.RefreshNow(ctx); err != nil {
+		t.Fatalf("RefreshNow() error = %v", err)
+	}
+	go s.RunOCSPRenewal(ctx)
+	// Fast forward until the loop fetched, it may still reschedule for the staple installed by RefreshNow
+	eventually(t, func() bool {
+		s.Testing().FastForward()
+		return requests.Load() >= 3
+	}, "renewal loop didn't fetch")
+
+	if got, want := withValue.Load(), requests.Load(); got != want {
+		t.Fatalf("%d of %d requests carried the context value", got, want)
+	}
+}
+
+func TestCancelAfterSuccessfulFetchInstallsStaple(t *testing.T) {
+	ca, certificate := newTestCertificate(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Shut down while the fetch of the renewal loop returns its response
+	var loopStarted atomic.Bool
+	responder := ca.transport(t)
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		response, err := responder(r)
+		if loopStarted.Load() {
+			cancel()
+		}
+		return response, err
+	})
+	s, err := NewStaplingE(context.Background(), certificate,
+		WithTransport(transport))
+	if err != nil {
+		t.Fatalf("NewStaplingE() error = %v", err)
+	}
+
+	loopStarted.Store(true)
+	s.Testing().FastForward()
+	s.RunOCSPRenewal(ctx)
+
+	if s.LastRenewal().IsZero() {
+		t.Fatal("staple fetched before the cancellation wasn't installed")
+	}
+	if certificate, _ := s.Certificate(); len(certificate.OCSPStaple) == 0 {
+		t.Fatal("certificate has no staple")
+	}
+}
+
+func TestSetCertificateWhileRenewalLoopStarts(t *testing.T) {
+	ca := newTestCA(t, "issuer")
+	issue := func(serial int64) tls.Certificate {
+		return ca.certificate(t, x509.Certificate{SerialNumber: big.NewInt(serial)})
+	}
+	s, err := NewStaplingE(context.Background(), issue(42), WithTransport(ca.transport(t)))
+	if err != nil {
+		t.Fatalf("NewStaplingE() error = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.RunOCSPRenewal(ctx)
+	}()
+	// Run with -race to detect unsynchronized access to the state SetCertificate changes
+	if err := s.SetCertificate(issue(43)); err != nil {
+		t.Fatalf("SetCertificate() error = %v", err)
+	}
+	eventually(t, func() bool { return !s.NextRenewal().IsZero() }, "renewal loop didn't schedule a renewal")
+	cancel()
+	<-done
+}
+
+func TestSetStaple(t *testing.T) {
+	ca, certificate := newTestCertificate(t)
+	now := time.Now()
+
+	tests := []struct {
+		name       string
+		nextUpdate time.Time
+		tolerance  time.Duration
+		wantErr    error
+	}{
+		{"valid", now.Add(time.Hour), 0, nil},
+		{"without NextUpdate", time.Time{}, 0, nil},
+		{"expired", now.Add(-time.Minute), 0, ErrResponseExpired},
+		{"expired within tolerance", now.Add(-time.Minute), time.Hour, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewStaplingE(context.Background(), certificate, WithTransport(ca.transport(t)),
+				WithImportTolerance(tt.tolerance))
+			if err != nil {
+				t.Fatalf("NewStaplingE() error = %v", err)
+			}
+			raw := ca.staple(t, 42, now.Add(-2*time.Hour), tt.nextUpdate)
+			if err := s.SetStaple(raw); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("SetStaple() error = %v, want %v", err, tt.wantErr)
+			}
+			if installed := s.StapleSource() == SourceImported; installed != (tt.wantErr == nil) {
+				t.Errorf("staple installed = %v, want %v", installed, tt.wantErr == nil)
+			}
+		})
+	}
+}
+
+func TestRenewalOverdueWhilePaused(t *testing.T) {
+	ca, certificate := newTestCertificate(t)
+	s, err := NewStaplingE(context.Background(), certificate, WithTransport(ca.transport(t)))
+	if err != nil {
+		t.Fatalf("NewStaplingE() error = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.RunOCSPRenewal(ctx)
+	eventually(t, func() bool { return !s.NextRenewal().IsZero() }, "renewal loop didn't schedule a renewal")
+
+	// The renewal of a paused loop passes by without fetching
+	s.Pause()
+	s.lock.Lock()
+	s.nextRenewal = time.Now().Add(-time.Hour)
+	s.lock.Unlock()
+	if s.RenewalOverdue() {
+		t.Fatal("RenewalOverdue() = true while paused")
+	}
+
+	s.Resume()
+	eventually(t, func() bool { return s.NextRenewal().After(time.Now()) }, "renewal wasn't rescheduled on Resume")
+	if s.RenewalOverdue() {
+		t.Fatal("RenewalOverdue() = true after Resume")
+	}
+}
+
+func TestRefreshNowWithoutRenewalLoop(t *testing.T) {
+	ca, certificate := newTestCertificate(t)
+	s, err := NewStaplingE(context.Background(), certificate, WithTransport(ca.transport(t)))
+	if err != nil {
+		t.Fatalf("NewStaplingE() error = %v", err)
+	}
+	if err := s.RefreshNow(context.Background()); err != nil {
+		t.Fatalf("RefreshNow() error = %v", err)
+	}
+	if next := s.NextRenewal(); !next.IsZero() {
+		t.Fatalf("NextRenewal() = %v without renewal loop, want zero", next)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.RunOCSPRenewal(ctx)
+	eventually(t, func() bool { return s.NextRenewal().After(time.Now()) }, "renewal loop didn't schedule a renewal")
+}
+
+// joinedContext marks joined as done once sharedRenew waits on it, which is after the caller joined the fetch in flight
+type joinedContext struct {
+	context.Context
+	once   sync.Once
+	joined *sync.WaitGroup
+}
+
+func (c *joinedContext) Done() <-chan struct{} {
+	c.once.Do(c.joined.Done)
+	return c.Context.Done()
+}
+
+func TestForceRenewCoalescesCalls(t *testing.T) {
+	ca, certificate := newTestCertificate(t)
+	var requests atomic.Int32
+	release := make(chan struct{})
+	responder := ca.transport(t)
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if requests.Add(1) > 1 {
+			// Hold the forced renewals until all callers joined
+			<-release
+		}
+		return responder(r)
+	})
+	s, err := NewStaplingE(context.Background(), certificate, WithTransport(transport))
+	if err != nil {
+		t.Fatalf("NewStaplingE() error = %v", err)
+	}
+
+	const callers = 10
+	var joined sync.WaitGroup
+	joined.Add(callers + 1)
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			errs <- s.ForceRenew(&joinedContext{Context: context.Background(), joined: &joined})
+		}()
+	}
+	// A caller giving up doesn't cancel the fetch shared with the others
+	ctx, cancel := context.WithCancel(context.Background())
+	abandoned := make(chan error, 1)
+	go func() {
+		abandoned <- s.ForceRenew(&joinedContext{Context: ctx, joined: &joined})
+	}()
+	joined.Wait()
+	cancel()
+	if err := <-abandoned; !errors.Is(err, context.Canceled) {
+		t.Fatalf("ForceRenew() of the cancelled caller error = %v, want context.Canceled", err)
+	}
+	close(release)
+
+	for i := 0; i < callers; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("ForceRenew() error = %v", err)
+		}
+	}
+	if got := requests.Load(); got != 2 {
+		t.Fatalf("responder contacted %d times for %d concurrent ForceRenew calls, want once", got-1, callers+1)
+	}
+
+	// Once the fetch completed, the next call fetches again
+	if err := s.ForceRenew(context.Background()); err != nil {
+		t.Fatalf("ForceRenew() error = %v", err)
+	}
+	if got := requests.Load(); got != 3 {
+		t.Fatalf("responder contacted %d times after the coalesced fetch, want once", got-2)
+	}
+}
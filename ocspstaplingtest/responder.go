@@ -0,0 +1,193 @@
+// Package ocspstaplingtest provides an OCSP responder for tests, so code using ocspstapling can be tested without
+// contacting a real CA.
+package ocspstaplingtest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"golang.org/x/crypto/ocsp"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+// defaultValidity is the validity period of responses when no NextUpdate is set
+const defaultValidity = time.Hour
+
+// Responder is an OCSP responder running on an httptest.Server. It answers requests for certificates issued by its issuer
+// with responses signed by the issuer key. The status and NextUpdate of the responses can be changed while it runs.
+type Responder struct {
+	// Server is the HTTP server the responder runs on
+	Server *httptest.Server
+	// Issuer is the CA certificate that issues the certificates and signs the responses
+	Issuer *x509.Certificate
+	// IssuerKey is the private key of Issuer
+	IssuerKey crypto.Signer
+
+	lock       sync.Mutex
+	status     int
+	revokedAt  time.Time
+	reason     int
+	nextUpdate time.Time
+	requests   int
+	serial     int64
+}
+
+// NewResponder generates an issuer and starts a responder answering ocsp.Good. Close must be called when done.
+func NewResponder() (*Responder, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ocspstaplingtest issuer"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	issuer, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Responder{Issuer: issuer, IssuerKey: key, status: ocsp.Good, serial: 1}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.serveHTTP))
+	return r, nil
+}
+
+// Close shuts down the server
+func (r *Responder) Close() {
+	r.Server.Close()
+}
+
+// URL returns the URL of the responder, as included in the certificates issued by Certificate
+func (r *Responder) URL() string {
+	return r.Server.URL
+}
+
+// SetStatus sets the status of the following responses to ocsp.Good or ocsp.Unknown, use SetRevoked for ocsp.Revoked
+func (r *Responder) SetStatus(status int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.status = status
+}
+
+// SetRevoked makes the following responses report the certificate as revoked at revokedAt, for the given ocsp reason code
+func (r *Responder) SetRevoked(revokedAt time.Time, reason int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.status = ocsp.Revoked
+	r.revokedAt = revokedAt
+	r.reason = reason
+}
+
+// SetNextUpdate sets the NextUpdate of the following responses. With the zero time, which is the default, every response
+// is valid for an hour after it was created.
+func (r *Responder) SetNextUpdate(nextUpdate time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.nextUpdate = nextUpdate
+}
+
+// Requests returns the number of OCSP requests the responder answered
+func (r *Responder) Requests() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.requests
+}
+
+// Certificate issues a leaf certificate for dnsNames, pointing at the responder as OCSP server. The returned certificate
+// contains the leaf followed by the issuer, and the private key of the leaf.
+func (r *Responder) Certificate(dnsNames ...string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	r.lock.Lock()
+	r.serial++
+	serial := r.serial
+	r.lock.Unlock()
+
+	commonName := "ocspstaplingtest leaf"
+	if len(dnsNames) > 0 {
+		commonName = dnsNames[0]
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		OCSPServer:   []string{r.URL()},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, r.Issuer, key.Public(), r.IssuerKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der, r.Issuer.Raw}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// serveHTTP answers POSTed OCSP requests with a response signed by the issuer
+func (r *Responder) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	request, err := ocsp.ParseRequest(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	r.lock.Lock()
+	r.requests++
+	now := time.Now()
+	template := ocsp.Response{
+		Status:           r.status,
+		SerialNumber:     request.SerialNumber,
+		ThisUpdate:       now,
+		NextUpdate:       r.nextUpdate,
+		RevokedAt:        r.revokedAt,
+		RevocationReason: r.reason,
+	}
+	r.lock.Unlock()
+	if template.NextUpdate.IsZero() {
+		template.NextUpdate = now.Add(defaultValidity)
+	}
+
+	response, err := ocsp.CreateResponse(r.Issuer, r.Issuer, template, r.IssuerKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	_, _ = w.Write(response)
+}
@@ -0,0 +1,51 @@
+package ocspstaplingtest_test
+
+import (
+	"context"
+	"github.com/rubenwo/ocspstapling"
+	"github.com/rubenwo/ocspstapling/ocspstaplingtest"
+	"golang.org/x/crypto/ocsp"
+	"testing"
+	"time"
+)
+
+func TestResponder(t *testing.T) {
+	responder, err := ocspstaplingtest.NewResponder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer responder.Close()
+	certificate, err := responder.Certificate("example.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certificate.Leaf.OCSPServer[0] != responder.URL() {
+		t.Fatalf("OCSP server = %q, want %q", certificate.Leaf.OCSPServer[0], responder.URL())
+	}
+
+	nextUpdate := time.Now().Add(2 * time.Hour).Truncate(time.Second)
+	responder.SetNextUpdate(nextUpdate)
+	s := ocspstapling.NewStapling(context.Background(), certificate)
+	if err := s.RefreshNow(context.Background()); err != nil {
+		t.Fatalf("RefreshNow() error = %v", err)
+	}
+	stapled, _ := s.Certificate()
+	response, err := ocsp.ParseResponseForCert(stapled.OCSPStaple, certificate.Leaf, responder.Issuer)
+	if err != nil {
+		t.Fatalf("staple doesn't parse: %v", err)
+	}
+	if response.Status != ocsp.Good || !response.NextUpdate.Equal(nextUpdate) {
+		t.Fatalf("staple status %d with NextUpdate %v, want good until %v", response.Status, response.NextUpdate, nextUpdate)
+	}
+
+	responder.SetRevoked(time.Now().Add(-time.Minute), ocsp.KeyCompromise)
+	if err := s.RefreshNow(context.Background()); err != nil {
+		t.Fatalf("RefreshNow() error = %v", err)
+	}
+	if _, reason, ok := s.RevocationInfo(); !ok || reason != ocsp.KeyCompromise {
+		t.Fatalf("RevocationInfo() = reason %d, revoked %v, want key compromise", reason, ok)
+	}
+	if got := responder.Requests(); got != 3 {
+		t.Fatalf("%d requests, want 3", got)
+	}
+}
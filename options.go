@@ -0,0 +1,655 @@
+package ocspstapling
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"fmt"
+	"golang.org/x/crypto/ocsp"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Option configures optional behaviour of a Stapling. Options are passed to NewStapling.
+type Option func(*config)
+
+// config holds the optional settings of a Stapling. The zero value of every field is the default behaviour.
+type config struct {
+	// importTolerance is how long after its NextUpdate a staple imported with SetStaple is still accepted
+	importTolerance time.Duration
+	// keepLongestValidity only replaces the current staple when a new response is valid for longer
+	keepLongestValidity bool
+	// embeddedResponderCert verifies responses against the responder certificate embedded in the response
+	embeddedResponderCert bool
+	// raceResponders sends the OCSP request to all responders concurrently
+	raceResponders bool
+	// requestSigner signs OCSP requests, requestSignerCert is included in the signed request
+	requestSigner     crypto.Signer
+	requestSignerCert *x509.Certificate
+	// allowedSignatureAlgorithms restricts the signature algorithms accepted on responses, empty allows all
+	allowedSignatureAlgorithms []x509.SignatureAlgorithm
+	// urlRewriter transforms each responder URL before it is contacted
+	urlRewriter func(string) string
+	// scheduler decides when the renewal loop fetches the next response
+	scheduler Scheduler
+	// verifyRoots is used to verify the chain of embedded responder certificates
+	verifyRoots *x509.CertPool
+	// issuerResolver looks up the issuer when it isn't unambiguous in the chain
+	issuerResolver func(leaf *x509.Certificate) (*x509.Certificate, error)
+	// expiredGrace is how long an expired staple is still served
+	expiredGrace time.Duration
+	// errorHistory is the number of errors kept for RecentErrors, nil uses the default
+	errorHistory *int
+	// responderByIssuer maps issuer common names or hex encoded subject key identifiers to responder URLs
+	responderByIssuer map[string]string
+	// requireNextUpdate rejects responses without NextUpdate
+	requireNextUpdate bool
+	// checkStapleOnServe verifies the staple belongs to the leaf every time the certificate is served
+	checkStapleOnServe bool
+	// prefetch is how long before the renewal instant the next response is fetched
+	prefetch time.Duration
+	// responseVerifier replaces the default parsing and signature verification of responses
+	responseVerifier func(raw []byte, issuer *x509.Certificate) (*ocsp.Response, error)
+	// responderAllowlist holds the lowercase hosts of the allowed responders, nil allows all responders
+	responderAllowlist map[string]struct{}
+	// allowlistReportOnly logs responders that are not on the allowlist instead of skipping them
+	allowlistReportOnly bool
+	// allowlistMisses counts the responders that were not on the allowlist. It is a pointer so copies of the config share it.
+	allowlistMisses *atomic.Uint64
+	// disableKeepAlive closes the connection to the responder after every request
+	disableKeepAlive bool
+	// httpClient is the client used to contact the responders, nil uses a default client
+	httpClient *http.Client
+	// transport replaces the transport of the HTTP client
+	transport http.RoundTripper
+	// httpTrace records the resolved addresses of the responder
+	httpTrace bool
+	// clockSkew is how far in the future the ThisUpdate of a fetched response may be
+	clockSkew time.Duration
+	// rejectStaleResponses rejects fetched responses that are older than the current staple
+	rejectStaleResponses bool
+	// bytesFetched counts the response bytes read from the responders. It is a pointer so copies of the config share it.
+	bytesFetched *atomic.Uint64
+	// byteBudget limits the response bytes fetched per window, nil is unlimited
+	byteBudget *byteBudget
+	// requestNonce includes a nonce in requests and verifies that responses echo it
+	requestNonce bool
+	// lenientNonce accepts responses without nonce
+	lenientNonce bool
+	// responderURL replaces the responders of the certificate
+	responderURL string
+	// leafSelector picks the leaf when the chain contains multiple end-entity certificates
+	leafSelector func(candidates []*x509.Certificate) (*x509.Certificate, error)
+	// store persists staples across restarts
+	store OCSPStore
+	// cacheSigningKey is the HMAC key that authenticates the staples in store, nil stores them unsigned
+	cacheSigningKey []byte
+	// allowNoOCSP accepts certificates without OCSP server in NewStaplingE
+	allowNoOCSP bool
+	// onRenewal is called with the outcome of every fetch
+	onRenewal func(RenewalResult)
+	// rediscoveryInterval is how often the renewal loop retries after it gave up, 0 disables rediscovery
+	rediscoveryInterval time.Duration
+	// aiaIssuers caches the issuers downloaded from the AIA extension, nil disables downloading. It is a pointer so copies
+	// of the config share it.
+	aiaIssuers *aiaIssuers
+	// aiaDownloads holds a slot for every issuer download in progress, it is shared to limit the concurrent downloads
+	aiaDownloads chan struct{}
+	// requireSCT rejects certificates without embedded SCTs
+	requireSCT bool
+	// fetchTimeout bounds every request to a responder, 0 means no deadline
+	fetchTimeout time.Duration
+	// stapleSink is called with every staple fetched from a responder
+	stapleSink func(ctx context.Context, raw []byte, nextUpdate time.Time) error
+	// maxRetries is how often a retryable fetch error is retried before giving up
+	maxRetries int
+	// backoff spaces the retries, nil uses the retry delay of the scheduler and one second more per retry on creation
+	backoff *Backoff
+	// requestHash is the hash algorithm of the issuer name and key hashes in the CertID of requests
+	requestHash crypto.Hash
+	// logger receives the log records of the package
+	logger *slog.Logger
+	// jitFetchTimeout is how long Manager.GetCertificate waits for a staple fetched during the handshake, 0 disables it
+	jitFetchTimeout time.Duration
+	// err is the error of the first invalid option, wrapping ErrInvalidOption
+	err error
+}
+
+// defaultClockSkew is the default allowance for the clock of the responder being ahead
+const defaultClockSkew = 5 * time.Minute
+
+// newConfig applies the options on top of the default configuration
+func newConfig(opts []Option) config {
+	cfg := config{
+		allowlistMisses: new(atomic.Uint64),
+		aiaDownloads:    aiaDownloads,
+		bytesFetched:    new(atomic.Uint64),
+		scheduler:       nextUpdateScheduler{},
+		clockSkew:       defaultClockSkew,
+		maxRetries:      defaultRetries,
+		requestHash:     crypto.SHA1,
+		logger:          slog.New(discardHandler{}),
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+// newHTTPClient returns the HTTP client used to contact the responders
+func (cfg *config) newHTTPClient() *http.Client {
+	client := &http.Client{}
+	if cfg.httpClient != nil {
+		// Copy the client, so setting the transport doesn't affect the caller's client
+		copied := *cfg.httpClient
+		client = &copied
+	}
+	if cfg.transport != nil {
+		client.Transport = cfg.transport
+	}
+	return client
+}
+
+// invalidOption returns an Option that records err, so the constructor it is passed to fails with ErrInvalidOption
+func invalidOption(err error) Option {
+	return func(cfg *config) {
+		if cfg.err == nil {
+			cfg.err = fmt.Errorf("%w: %w", ErrInvalidOption, err)
+		}
+	}
+}
+
+// discardHandler is a slog.Handler that drops all records
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+// WithImportTolerance accepts staples imported with SetStaple that expired less than d ago.
+// This makes push/pull setups robust against propagation delays. By default expired staples are always rejected.
+func WithImportTolerance(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.importTolerance = d
+	}
+}
+
+// WithKeepLongestValidity makes the renewal loop only replace the current staple when the newly fetched response has a
+// later NextUpdate, or when the current staple has expired. This maximizes the time between fetches when responders
+// return responses of different ages. By default the newest fetched response is always used.
+func WithKeepLongestValidity(keep bool) Option {
+	return func(cfg *config) {
+		cfg.keepLongestValidity = keep
+	}
+}
+
+// WithEmbeddedResponderCert parses OCSP responses using the responder certificate embedded in the response, and then
+// explicitly verifies that this responder certificate was issued by the certificate's issuer and may sign OCSP responses.
+// This helps with responders that sign with a delegated responder certificate rather than the issuer's key.
+func WithEmbeddedResponderCert(embedded bool) Option {
+	return func(cfg *config) {
+		cfg.embeddedResponderCert = embedded
+	}
+}
+
+// WithRaceResponders sends the OCSP request to all responders listed in the certificate concurrently and uses the first
+// valid response, cancelling the other requests. This minimizes fetch latency at the cost of more requests.
+// By default the responders are tried one after the other.
+func WithRaceResponders(race bool) Option {
+	return func(cfg *config) {
+		cfg.raceResponders = race
+	}
+}
+
+// WithSignRequest signs every OCSP request with signer, for responders that reject unsigned requests. The certificate of
+// the signer is used as the requestor name and included in the request, it may be nil. RSA, ECDSA and Ed25519 keys are
+// supported. By default requests are unsigned.
+func WithSignRequest(signer crypto.Signer, cert *x509.Certificate) Option {
+	return func(cfg *config) {
+		cfg.requestSigner = signer
+		cfg.requestSignerCert = cert
+	}
+}
+
+// WithAllowedSignatureAlgorithms rejects OCSP responses, and embedded responder certificates, signed with an algorithm that
+// is not in algorithms with ErrWeakResponseSignature. By default all algorithms supported by x509 are allowed.
+func WithAllowedSignatureAlgorithms(algorithms []x509.SignatureAlgorithm) Option {
+	return func(cfg *config) {
+		cfg.allowedSignatureAlgorithms = append([]x509.SignatureAlgorithm(nil), algorithms...)
+	}
+}
+
+// WithURLRewriter applies rewrite to every OCSP server URL of the certificate before it is contacted, e.g. to map external
+// responders to internal mirrors by pattern.
+func WithURLRewriter(rewrite func(string) string) Option {
+	return func(cfg *config) {
+		cfg.urlRewriter = rewrite
+	}
+}
+
+// WithCronSchedule renews the staple at the times matching the standard 5 field cron spec (minute hour day-of-month month
+// day-of-week) in the local time zone, e.g. "0 3 * * *" for 03:00 every day. NextUpdate stays the upper bound: when the
+// next scheduled time is after NextUpdate, the staple is renewed at NextUpdate. An invalid spec makes NewStaplingE, Process
+// and Manager.Add fail with ErrInvalidOption.
+func WithCronSchedule(spec string) Option {
+	scheduler, err := NewCronScheduler(spec)
+	if err != nil {
+		return invalidOption(err)
+	}
+	return WithScheduler(scheduler)
+}
+
+// WithScheduler replaces the renewal scheduling policy with scheduler, which the renewal loop consults after every fetch to
+// decide when to fetch next. Options that configure the built-in schedulers, like WithCronSchedule, replace a scheduler set
+// earlier. The number of retries after failed fetches is not affected. A nil scheduler restores the default, which renews at
+// NextUpdate and retries failed fetches after a minute. The scheduler must not call methods of the Stapling, see Scheduler.
+func WithScheduler(scheduler Scheduler) Option {
+	if scheduler == nil {
+		scheduler = nextUpdateScheduler{}
+	}
+	return func(cfg *config) {
+		cfg.scheduler = scheduler
+	}
+}
+
+// WithVerifyRoots verifies the responder certificate embedded in OCSP responses by building a chain to one of the roots in
+// pool, with the certificate's issuer available as intermediate. The chain must pass through the issuer, and the responder
+// certificate must have the OCSP signing extended key usage. This handles delegated responders whose certificate chains to
+// the issuer via additional intermediates.
+func WithVerifyRoots(pool *x509.CertPool) Option {
+	return func(cfg *config) {
+		cfg.verifyRoots = pool
+	}
+}
+
+// WithIssuerResolver consults resolve for the issuer certificate of the leaf when the issuer isn't unambiguous in the chain,
+// i.e. when no chain certificate has the leaf's issuer as subject, or when multiple do and none of them signed the leaf.
+// This lets callers with multiple CAs look up the correct issuer from their own store. Without a resolver the second
+// certificate in the chain is used, or ErrIssuerNotFound is returned when multiple candidates didn't sign the leaf.
+func WithIssuerResolver(resolve func(leaf *x509.Certificate) (*x509.Certificate, error)) Option {
+	return func(cfg *config) {
+		cfg.issuerResolver = resolve
+	}
+}
+
+// WithExpiredGrace keeps serving an expired staple for up to d past its NextUpdate while the renewal loop retries, after
+// which it is stripped from the certificate. This bridges short responder outages. Clients that check the validity of the
+// staple will reject the expired response: soft-fail clients fall back to their own revocation checking (or none), and
+// hard-fail clients, or any client for a Must-Staple certificate, fail the handshake. By default (0) an expired staple is
+// stripped immediately.
+func WithExpiredGrace(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.expiredGrace = d
+	}
+}
+
+// WithErrorHistory keeps the last n renewal errors for RecentErrors. By default the last 16 errors are kept, n <= 0
+// disables the history.
+func WithErrorHistory(n int) Option {
+	if n < 0 {
+		n = 0
+	}
+	return func(cfg *config) {
+		cfg.errorHistory = &n
+	}
+}
+
+// WithResponderByIssuer configures responders for certificates that don't define an OCSP server, e.g. from legacy internal
+// PKIs that didn't populate the AIA extension. responders maps the issuer's common name, or its subject key identifier as
+// lowercase hex, to the responder URL. The map is only consulted when the certificate has no OCSP server.
+func WithResponderByIssuer(responders map[string]string) Option {
+	copied := make(map[string]string, len(responders))
+	for issuer, responder := range responders {
+		copied[issuer] = responder
+	}
+	return func(cfg *config) {
+		cfg.responderByIssuer = copied
+	}
+}
+
+// WithRequireNextUpdate rejects OCSP responses that don't specify a NextUpdate with ErrMissingNextUpdate, so only responders
+// providing an explicit expiry are trusted. By default such responses are accepted.
+func WithRequireNextUpdate(require bool) Option {
+	return func(cfg *config) {
+		cfg.requireNextUpdate = require
+	}
+}
+
+// WithStapleCheckOnServe verifies, every time the certificate is served, that the staple is for the serial number of the
+// leaf. On a mismatch the staple is not served and ErrStapleKeyMismatch is logged. This catches cross-contamination in
+// shared-cache deployments at the cost of parsing the leaf per handshake when tls.Certificate.Leaf isn't set.
+// Staples imported with SetStaple are always checked.
+func WithStapleCheckOnServe(check bool) Option {
+	return func(cfg *config) {
+		cfg.checkStapleOnServe = check
+	}
+}
+
+// WithPrefetch fetches the next OCSP response lead before the renewal instant and keeps it staged until that instant, when it
+// is swapped in. A slow or failing fetch then can't leave a gap without a valid staple, which matters for Must-Staple
+// certificates. Failed prefetches are retried as usual. By default the response is fetched at the renewal instant.
+func WithPrefetch(lead time.Duration) Option {
+	return func(cfg *config) {
+		cfg.prefetch = lead
+	}
+}
+
+// WithResponseVerifier replaces the default parsing and signature verification of OCSP responses (golang.org/x/crypto/ocsp,
+// see also WithEmbeddedResponderCert and WithVerifyRoots) with verify, e.g. for HSM-backed verification. verify must return
+// the parsed response only when its signature is valid for the issuer. Errors are wrapped in ErrCouldNotParseResponse. The
+// other checks on the response, like WithAllowedSignatureAlgorithms, still apply.
+func WithResponseVerifier(verify func(raw []byte, issuer *x509.Certificate) (*ocsp.Response, error)) Option {
+	return func(cfg *config) {
+		cfg.responseVerifier = verify
+	}
+}
+
+// WithResponderAllowlist only contacts OCSP responders whose host is in hosts, after URL rewriting. Responders that are not
+// allowed are skipped, and ErrResponderNotAllowed is returned when no responder is left. By default all responders are allowed.
+func WithResponderAllowlist(hosts []string) Option {
+	allowlist := make(map[string]struct{}, len(hosts))
+	for _, host := range hosts {
+		allowlist[strings.ToLower(host)] = struct{}{}
+	}
+	return func(cfg *config) {
+		cfg.responderAllowlist = allowlist
+	}
+}
+
+// WithAllowlistReportOnly makes the allowlist of WithResponderAllowlist report-only: responders that are not allowed are
+// logged (see WithLogger) and counted (see Stapling.AllowlistMisses), but still contacted. This allows observing which
+// responders would be blocked before enforcing the allowlist.
+func WithAllowlistReportOnly(reportOnly bool) Option {
+	return func(cfg *config) {
+		cfg.allowlistReportOnly = reportOnly
+	}
+}
+
+// WithDisableKeepAlive closes the connection to the responder after every request, which also sends Connection: close.
+// This works around legacy responders that misbehave, e.g. serve stale data, over reused connections. It applies to any
+// transport configured with WithHTTPClient or WithTransport. By default connections are kept alive.
+func WithDisableKeepAlive(disable bool) Option {
+	return func(cfg *config) {
+		cfg.disableKeepAlive = disable
+	}
+}
+
+// WithHTTPClient contacts the responders with client, e.g. to configure timeouts, a proxy or a custom transport. It is used
+// for all requests, including the ones made by NewStapling. By default a client without timeout is used, so a hung responder
+// can block a fetch until its context is cancelled.
+func WithHTTPClient(client *http.Client) Option {
+	return func(cfg *config) {
+		cfg.httpClient = client
+	}
+}
+
+// WithFetchTimeout gives every request to a responder a deadline of d, on top of the context of the fetch. A responder that
+// doesn't answer in time fails with ErrCouldNotPostOCSPRequest, and the next responder is tried. By default requests only
+// end when the context is cancelled or the HTTP client times out.
+func WithFetchTimeout(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.fetchTimeout = d
+	}
+}
+
+// WithTransport contacts the responders through transport, which may be any http.RoundTripper. It replaces the transport of
+// the client configured with WithHTTPClient, without modifying that client. For responders offering HTTP/3, pass an HTTP/3
+// round tripper, e.g. the http3.Transport of github.com/quic-go/quic-go:
+//
+//	ocspstapling.NewStapling(ctx, cert, ocspstapling.WithTransport(&http3.Transport{}))
+//
+// By default http.DefaultTransport is used.
+func WithTransport(transport http.RoundTripper) Option {
+	return func(cfg *config) {
+		cfg.transport = transport
+	}
+}
+
+// WithHTTPTrace traces the requests to the responders with net/http/httptrace and records the IP addresses the responder host
+// resolved to, see Stapling.LastResponderAddrs. This helps correlating geo load balanced or anycast responders with
+// incident reports of the CA, at the cost of tracing every request. By default requests are not traced.
+func WithHTTPTrace(trace bool) Option {
+	return func(cfg *config) {
+		cfg.httpTrace = trace
+	}
+}
+
+// WithClockSkew allows the ThisUpdate of a fetched response to be up to d in the future, to tolerate clock drift between this
+// host and the responder. Responses with a later ThisUpdate, or whose NextUpdate has passed, are rejected with
+// ErrOCSPResponseExpired. By default 5 minutes of skew are allowed.
+func WithClockSkew(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.clockSkew = d
+	}
+}
+
+// WithRejectStaleResponses rejects a fetched response whose ThisUpdate is before the ThisUpdate of the current staple with
+// ErrStaleResponse, which is retried like a connectivity error. This prevents a lagging responder or cache from regressing
+// the staple. It only applies once a staple is installed. By default every valid fetched response is installed.
+func WithRejectStaleResponses(reject bool) Option {
+	return func(cfg *config) {
+		cfg.rejectStaleResponses = reject
+	}
+}
+
+// WithRenewalFraction renews the staple once fraction of the validity period between ThisUpdate and NextUpdate has elapsed,
+// e.g. 0.5 renews halfway, which leaves time to retry before the staple expires. fraction must be in (0, 1], otherwise
+// NewStaplingE, Process and Manager.Add fail with ErrInvalidOption. It replaces a scheduler set earlier, see WithScheduler.
+// By default the staple is renewed at NextUpdate.
+func WithRenewalFraction(fraction float64) Option {
+	if fraction <= 0 || fraction > 1 {
+		return invalidOption(fmt.Errorf("renewal fraction %v is not in (0, 1]", fraction))
+	}
+	return WithScheduler(fractionScheduler{fraction: fraction})
+}
+
+// WithByteBudget limits the response bytes fetched from the responders to n per window, for edge deployments on metered
+// links. Once the budget of the current window is used up, fetches fail with ErrByteBudgetExceeded and the renewal loop
+// backs off until the next window starts. The response that exceeds the budget is still used. By default fetching is
+// unlimited, see Stapling.BytesFetched for the total. n must be positive and window longer than zero.
+func WithByteBudget(n uint64, window time.Duration) Option {
+	if n == 0 {
+		return invalidOption(fmt.Errorf("byte budget %d is not positive", n))
+	}
+	if window <= 0 {
+		return invalidOption(fmt.Errorf("byte budget window %v is not positive", window))
+	}
+	return func(cfg *config) {
+		cfg.byteBudget = &byteBudget{limit: n, window: window}
+	}
+}
+
+// WithRequestNonce includes a random nonce in every OCSP request and rejects responses that don't echo it with
+// ErrOCSPNonceMismatch, which protects renewals against replayed responses. Many responders, especially those behind a CDN,
+// don't support nonces, see WithLenientNonce. By default no nonce is sent.
+func WithRequestNonce(nonce bool) Option {
+	return func(cfg *config) {
+		cfg.requestNonce = nonce
+	}
+}
+
+// WithLenientNonce accepts responses without nonce when WithRequestNonce is set, for responders that don't support nonces.
+// A response with a different nonce is still rejected. By default a missing nonce is rejected.
+func WithLenientNonce(lenient bool) Option {
+	return func(cfg *config) {
+		cfg.lenientNonce = lenient
+	}
+}
+
+// WithResponderURL sends all OCSP requests to url instead of the OCSP servers listed in the certificate, e.g. an internal
+// mirror or a single egress point in air-gapped environments. The URL rewriter isn't applied to it, and responses are still
+// verified against the issuer of the certificate. By default the OCSP servers of the certificate are used.
+func WithResponderURL(url string) Option {
+	return func(cfg *config) {
+		cfg.responderURL = url
+	}
+}
+
+// WithLeafSelector consults selectLeaf when the certificate chain contains multiple end-entity certificates, e.g. a messy
+// bundle, to pick the certificate to fetch OCSP responses for. Certificates that are CAs, may sign certificates or are
+// self-signed aren't end-entity certificates. candidates holds the end-entity certificates in chain order, the selector may
+// e.g. match a known public key. Note that crypto/tls always serves the first certificate of the
+// chain as leaf. Without a selector such chains are rejected with ErrAmbiguousLeaf.
+func WithLeafSelector(selectLeaf func(candidates []*x509.Certificate) (*x509.Certificate, error)) Option {
+	return func(cfg *config) {
+		cfg.leafSelector = selectLeaf
+	}
+}
+
+// WithStore persists every installed staple in store, and starts with the stored staple when it is still valid, so restarts
+// don't have to contact the responder. The staple is then served right away, NewStapling doesn't probe the responder and the
+// renewal loop schedules the first renewal based on the stored staple. See NewFileStore for a file based store. By default
+// staples are not persisted.
+func WithStore(store OCSPStore) Option {
+	return func(cfg *config) {
+		cfg.store = store
+	}
+}
+
+// WithCacheSigningKey signs the staples saved to the store configured with WithStore with an HMAC-SHA256 over the staple
+// and its CacheKey, e.g. for a store in a shared or less trusted location. A stored staple whose signature doesn't match,
+// including an unsigned one, is rejected with ErrCacheTampered and a new staple is fetched. The staple itself is verified
+// against the issuer either way, the signature catches corrupted and planted files early. All instances sharing a store
+// must use the same key. By default staples are stored unsigned.
+func WithCacheSigningKey(key []byte) Option {
+	return func(cfg *config) {
+		cfg.cacheSigningKey = append([]byte(nil), key...)
+	}
+}
+
+// WithAllowNoOCSP makes NewStaplingE accept certificates without OCSP server, e.g. in fleets where some certificates
+// intentionally don't support OCSP. Such certificates are served without staple and no error is returned, so other errors
+// can still be treated as fatal. Use Stapling.HasOCSP to tell them apart. By default NewStaplingE returns
+// ErrNoOCSPServerDefined for them.
+func WithAllowNoOCSP(allow bool) Option {
+	return func(cfg *config) {
+		cfg.allowNoOCSP = allow
+	}
+}
+
+// WithOnRenewal calls onRenewal with the outcome of every fetch of the renewal loop, ForceRenew and RefreshNow, e.g. to
+// export metrics. It is called synchronously without holding any lock, so it may call methods of the Stapling, but a slow
+// callback delays the renewal. See also Stapling.Events.
+func WithOnRenewal(onRenewal func(result RenewalResult)) Option {
+	return func(cfg *config) {
+		cfg.onRenewal = onRenewal
+	}
+}
+
+// WithRediscoveryInterval keeps the renewal loop running after it gave up on OCSP stapling, because of a fatal error, too
+// many failed retries or because stapling was disabled on creation. It then retries fetching about every d, with 10% jitter,
+// and enables stapling again once a fetch succeeds, e.g. when a responder misconfiguration is fixed hours later. By default
+// the renewal loop returns when it gives up.
+func WithRediscoveryInterval(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.rediscoveryInterval = d
+	}
+}
+
+// WithAIAIssuerFetch downloads the issuer certificate from the CA Issuers URL in the Authority Information Access extension
+// of the leaf when the chain doesn't contain it, e.g. for deployments that only ship the leaf. The downloaded certificate
+// must have signed the leaf, and is cached so it is only downloaded once. When the download fails, the fetch fails with
+// ErrIssuerDownloadFailed and is retried. By default the issuer must be in the chain.
+func WithAIAIssuerFetch(fetch bool) Option {
+	return func(cfg *config) {
+		cfg.aiaIssuers = nil
+		if fetch {
+			cfg.aiaIssuers = &aiaIssuers{issuers: make(map[string]*x509.Certificate)}
+		}
+	}
+}
+
+// WithAIAConcurrency limits the issuer downloads of WithAIAIssuerFetch in progress at the same time to n, shared by all
+// Staplings created with the returned Option, e.g. all certificates of a Manager. This protects the CA Issuers endpoint of
+// the CA, which is often less provisioned than its responder, when many certificates start at once. n must be at least 1,
+// otherwise NewStaplingE, Process and Manager.Add fail with ErrInvalidOption. By default at most 4 downloads are in progress
+// at the same time in the process.
+func WithAIAConcurrency(n int) Option {
+	if n < 1 {
+		return invalidOption(fmt.Errorf("AIA concurrency %d is less than 1", n))
+	}
+	downloads := make(chan struct{}, n)
+	return func(cfg *config) {
+		cfg.aiaDownloads = downloads
+	}
+}
+
+// WithRequireSCT rejects certificates that don't carry embedded Signed Certificate Timestamps with ErrMissingSCT, before
+// contacting a responder. Browsers enforcing Certificate Transparency may reject such certificates regardless of the
+// staple, so this catches misissued certificates early. It only checks that SCTs are present, they aren't verified.
+// By default certificates without SCTs are accepted.
+func WithRequireSCT(require bool) Option {
+	return func(cfg *config) {
+		cfg.requireSCT = require
+	}
+}
+
+// WithStapleSink pushes every staple fetched from a responder to sink after it was installed, e.g. to distribute staples
+// from a central instance through S3 or Redis to instances that import them with SetStaple. The sink is called in the
+// background with the raw response, which must not be modified, and its NextUpdate. Errors are logged and don't affect
+// local stapling. Staples that were imported or loaded from the store aren't pushed.
+func WithStapleSink(sink func(ctx context.Context, raw []byte, nextUpdate time.Time) error) Option {
+	return func(cfg *config) {
+		cfg.stapleSink = sink
+	}
+}
+
+// WithMaxRetries sets how often a fetch failing with a retryable error, e.g. a connectivity issue, is retried, so at most
+// n+1 attempts are made. It applies to the check whether stapling can be used on creation, and to the consecutive failed
+// fetches after which the renewal loop gives up. n must not be negative, otherwise NewStaplingE, Process and Manager.Add
+// fail with ErrInvalidOption. By default 9 retries are made.
+func WithMaxRetries(n int) Option {
+	if n < 0 {
+		return invalidOption(fmt.Errorf("max retries %d is negative", n))
+	}
+	return func(cfg *config) {
+		cfg.maxRetries = n
+	}
+}
+
+// WithRetryBackoff spaces the retries made on creation, when checking whether stapling can be used, and the retries of the
+// renewal loop according to b. A custom Scheduler set with WithScheduler still decides the retries of the renewal loop
+// itself. By default the n-th retry on creation is made after n seconds, i.e. Backoff{Base: time.Second}, and the renewal
+// loop retries as the scheduler decides.
+func WithRetryBackoff(b Backoff) Option {
+	return func(cfg *config) {
+		cfg.backoff = &b
+	}
+}
+
+// WithRequestHash sets the hash algorithm of the issuer name and key hashes in OCSP requests, e.g. crypto.SHA256 for
+// responders that require it. SHA-1, SHA-256, SHA-384 and SHA-512 are supported, other algorithms make every fetch fail
+// with ErrCouldNotCreateOCSPRequest. By default SHA-1 is used, which is accepted by all responders.
+func WithRequestHash(hash crypto.Hash) Option {
+	return func(cfg *config) {
+		cfg.requestHash = hash
+	}
+}
+
+// WithLogger sends the log records of the package to logger, e.g. to add attributes identifying the certificate. Besides
+// warnings, like a failing store, the renewal loop logs every renewal with the time of the next one at info level, every
+// retry with its attempt number at warn level, and the reason when it disables stapling at error level. Its scheduling
+// decisions are logged at debug level. By default, or with a nil logger, nothing is logged.
+func WithLogger(logger *slog.Logger) Option {
+	return func(cfg *config) {
+		if logger == nil {
+			logger = slog.New(discardHandler{})
+		}
+		cfg.logger = logger
+	}
+}
+
+// WithJITFetch makes Manager.GetCertificate fetch a staple during the handshake when the selected certificate has none yet,
+// e.g. because it was added without priming it with Stapling.RefreshNow. The handshake waits at most timeout for the fetch,
+// and is served without staple when it doesn't complete in time. Concurrent handshakes share the fetch, which is cancelled
+// by Manager.Close. Fetching in the handshake path adds the latency of the responder to the handshake, so it is disabled by
+// default, and with a timeout of 0. It only applies to certificates served by a Manager.
+func WithJITFetch(timeout time.Duration) Option {
+	return func(cfg *config) {
+		cfg.jitFetchTimeout = timeout
+	}
+}
@@ -0,0 +1,123 @@
+package ocspstapling
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestInvalidOptions(t *testing.T) {
+	ca, certificate := newTestCertificate(t)
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		t.Errorf("responder contacted with an invalid option")
+		return ca.transport(t)(r)
+	})
+
+	tests := []struct {
+		name   string
+		option Option
+	}{
+		{"cron spec", WithCronSchedule("every day")},
+		{"zero renewal fraction", WithRenewalFraction(0)},
+		{"renewal fraction above 1", WithRenewalFraction(1.5)},
+		{"negative max retries", WithMaxRetries(-1)},
+		{"zero AIA concurrency", WithAIAConcurrency(0)},
+		{"zero byte budget", WithByteBudget(0, time.Hour)},
+		{"zero byte budget window", WithByteBudget(1024, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewStaplingE(context.Background(), certificate, WithTransport(transport), tt.option); !errors.Is(err, ErrInvalidOption) {
+				t.Errorf("NewStaplingE() error = %v, want ErrInvalidOption", err)
+			}
+			if _, _, err := Process(context.Background(), certificate, WithTransport(transport), tt.option); !errors.Is(err, ErrInvalidOption) {
+				t.Errorf("Process() error = %v, want ErrInvalidOption", err)
+			}
+			if _, err := NewManager(WithTransport(transport), tt.option).Add(context.Background(), certificate); !errors.Is(err, ErrInvalidOption) {
+				t.Errorf("Manager.Add() error = %v, want ErrInvalidOption", err)
+			}
+		})
+	}
+}
+
+func TestMaxRetriesOnCreation(t *testing.T) {
+	_, certificate := newTestCertificate(t)
+
+	tests := []struct {
+		maxRetries   int
+		wantAttempts int32
+	}{
+		{0, 1},
+		{1, 2},
+		{3, 4},
+	}
+	for _, tt := range tests {
+		var attempts atomic.Int32
+		transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			attempts.Add(1)
+			return &http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{}, Body: http.NoBody}, nil
+		})
+		_, err := NewStaplingE(context.Background(), certificate, WithTransport(transport), WithMaxRetries(tt.maxRetries),
+			WithRetryBackoff(Backoff{Base: time.Millisecond}))
+		if !errors.Is(err, ErrUnexpectedHTTPStatus) {
+			t.Errorf("WithMaxRetries(%d): NewStaplingE() error = %v, want ErrUnexpectedHTTPStatus", tt.maxRetries, err)
+		}
+		if got := attempts.Load(); got != tt.wantAttempts {
+			t.Errorf("WithMaxRetries(%d): %d attempts, want %d", tt.maxRetries, got, tt.wantAttempts)
+		}
+	}
+}
+
+func TestMaxRetriesInRenewalLoop(t *testing.T) {
+	ca, certificate := newTestCertificate(t)
+	// The fetch on creation succeeds, all fetches of the renewal loop fail
+	var requests atomic.Int32
+	responder := ca.transport(t)
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if requests.Add(1) == 1 {
+			return responder(r)
+		}
+		return &http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{}, Body: http.NoBody}, nil
+	})
+	s, err := NewStaplingE(context.Background(), certificate,
+		WithTransport(transport), WithMaxRetries(2), WithRetryBackoff(Backoff{Base: time.Millisecond}))
+	if err != nil {
+		t.Fatalf("NewStaplingE() error = %v", err)
+	}
+	s.Testing().FastForward()
+	// The loop returns once it gave up
+	s.RunOCSPRenewal(context.Background())
+	if got := requests.Load(); got != 4 {
+		t.Fatalf("%d requests, want 1 on creation and 3 attempts of the renewal loop", got)
+	}
+}
+
+func TestRetryBackoffInRenewalLoop(t *testing.T) {
+	ca, certificate := newTestCertificate(t)
+	// The fetch on creation succeeds, the first two fetches of the renewal loop fail
+	var requests atomic.Int32
+	responder := ca.transport(t)
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if n := requests.Add(1); n == 2 || n == 3 {
+			return &http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{}, Body: http.NoBody}, nil
+		}
+		return responder(r)
+	})
+	s, err := NewStaplingE(context.Background(), certificate,
+		WithTransport(transport), WithRetryBackoff(Backoff{Base: time.Millisecond}))
+	if err != nil {
+		t.Fatalf("NewStaplingE() error = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.RunOCSPRenewal(ctx)
+
+	// Without the backoff, the default scheduler retries after a minute
+	eventually(t, func() bool { return !s.LastRenewal().IsZero() }, "renewal loop didn't retry with the backoff")
+	if got := requests.Load(); got != 4 {
+		t.Errorf("%d requests, want 4", got)
+	}
+}
@@ -0,0 +1,62 @@
+package ocspstapling
+
+import (
+	"context"
+	"crypto/tls"
+	"golang.org/x/crypto/ocsp"
+)
+
+// Process staples a single OCSP response to certificate, without a Stapling or renewal loop. It validates the chain locally
+// (see Stapling.ValidateCertificateLocal), fetches a response from the responders of the leaf as configured by opts, and
+// verifies that the response is for the leaf, signed by the issuer and currently valid (see WithClockSkew). It returns a copy
+// of certificate with the staple attached and the parsed response. When the certificate is revoked, or the responder doesn't
+// know it, the stapled certificate and response are returned together with ErrCertificateRevoked or
+// ErrCertificateStatusUnknown.
+func Process(ctx context.Context, certificate tls.Certificate, opts ...Option) (tls.Certificate, *ocsp.Response, error) {
+	cfg := newConfig(opts)
+	if cfg.err != nil {
+		return tls.Certificate{}, nil, cfg.err
+	}
+	httpClient := cfg.newHTTPClient()
+	if cfg.aiaIssuers != nil {
+		// The chain can only be validated with the issuer, download it when it is missing
+		if err := cfg.aiaIssuers.download(ctx, httpClient, certificate, &cfg); err != nil {
+			return tls.Certificate{}, nil, err
+		}
+	}
+	if err := validateChain(certificate, &cfg); err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	result, err := fetchOCSP(ctx, certificate, httpClient, &cfg)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	response := result.response
+
+	certificate.OCSPStaple = result.raw
+	switch response.Status {
+	case ocsp.Revoked:
+		return certificate, response, ErrCertificateRevoked
+	case ocsp.Unknown:
+		return certificate, response, ErrCertificateStatusUnknown
+	}
+	return certificate, response, nil
+}
+
+// validateChain checks, without any network I/O, that the certificate can be used for OCSP stapling
+func validateChain(certificate tls.Certificate, cfg *config) error {
+	x509Cert, x509Issuer, err := parseChain(certificate, cfg)
+	if err != nil {
+		return err
+	}
+	if err := x509Cert.CheckSignatureFrom(x509Issuer); err != nil {
+		return ErrIssuerMismatch
+	}
+	if cfg.requireSCT && !hasEmbeddedSCTs(x509Cert) {
+		return ErrMissingSCT
+	}
+	if len(cfg.responders(x509Cert, x509Issuer)) == 0 {
+		return ErrNoOCSPServerDefined
+	}
+	return nil
+}
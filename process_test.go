@@ -0,0 +1,60 @@
+package ocspstapling
+
+import (
+	"context"
+	"crypto/x509"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProcessDownloadsMissingIssuer(t *testing.T) {
+	ca := newTestCA(t, "issuer")
+	certificate := ca.certificate(t, x509.Certificate{IssuingCertificateURL: []string{"http://ca.example/issuer.der"}})
+	certificate.Certificate = certificate.Certificate[:1]
+
+	stapled, _, err := Process(context.Background(), certificate, WithTransport(ca.transport(t)), WithAIAIssuerFetch(true))
+	if err != nil {
+		t.Fatalf("Process() error = %v", err)
+	}
+	if len(stapled.OCSPStaple) == 0 {
+		t.Fatal("Process() returned a certificate without staple")
+	}
+}
+
+func TestProcessAIAConcurrency(t *testing.T) {
+	ca := newTestCA(t, "issuer")
+	certificate := ca.certificate(t, x509.Certificate{IssuingCertificateURL: []string{"http://ca.example/issuer.der"}})
+	certificate.Certificate = certificate.Certificate[:1]
+	// Track the most issuer downloads in progress at the same time
+	var downloading, most atomic.Int32
+	responder := ca.transport(t)
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if r.Method == http.MethodGet {
+			n := downloading.Add(1)
+			defer downloading.Add(-1)
+			for m := most.Load(); n > m && !most.CompareAndSwap(m, n); m = most.Load() {
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		return responder(r)
+	})
+
+	limit := WithAIAConcurrency(2)
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := Process(context.Background(), certificate, WithTransport(transport), WithAIAIssuerFetch(true), limit); err != nil {
+				t.Errorf("Process() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := most.Load(); got != 2 {
+		t.Fatalf("%d issuer downloads in progress at the same time, want 2", got)
+	}
+}
@@ -0,0 +1,136 @@
+package ocspstapling
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+)
+
+// These structures reflect the ASN.1 structure of an OCSP request, see RFC 6960 section 4.1.1.
+// golang.org/x/crypto/ocsp can only create unsigned requests without extensions, so signed requests and requests with a
+// nonce are built from these.
+
+type unsignedRequestASN1 struct {
+	TBSRequest unsignedTBSRequestASN1
+}
+
+type unsignedTBSRequestASN1 struct {
+	Version           int `asn1:"explicit,tag:0,default:0,optional"`
+	RequestList       []asn1.RawValue
+	RequestExtensions []pkix.Extension `asn1:"explicit,tag:2,optional"`
+}
+
+type tbsRequestASN1 struct {
+	Version int `asn1:"explicit,tag:0,default:0,optional"`
+	// RequestorName holds the complete [1] EXPLICIT GeneralName, encoding/asn1 ignores tags on a RawValue
+	RequestorName     asn1.RawValue `asn1:"optional"`
+	RequestList       []asn1.RawValue
+	RequestExtensions []pkix.Extension `asn1:"explicit,tag:2,optional"`
+}
+
+type signatureASN1 struct {
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certs              []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type signedRequestASN1 struct {
+	TBSRequest        asn1.RawValue
+	OptionalSignature signatureASN1 `asn1:"explicit,tag:0"`
+}
+
+var (
+	oidSignatureSHA256WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidSignatureECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidSignatureEd25519         = asn1.ObjectIdentifier{1, 3, 101, 112}
+)
+
+// signRequest signs the DER encoded unsigned OCSP request with signer. When cert is not nil, it is used as requestorName
+// and included in the request so the responder can verify the signature.
+func signRequest(ocspRequest []byte, signer crypto.Signer, cert *x509.Certificate) ([]byte, error) {
+	var unsigned unsignedRequestASN1
+	if rest, err := asn1.Unmarshal(ocspRequest, &unsigned); err != nil || len(rest) != 0 {
+		return nil, ErrRequestSigningFailed
+	}
+
+	tbs := tbsRequestASN1{
+		Version:           unsigned.TBSRequest.Version,
+		RequestList:       unsigned.TBSRequest.RequestList,
+		RequestExtensions: unsigned.TBSRequest.RequestExtensions,
+	}
+	if cert != nil {
+		// requestorName [1] EXPLICIT GeneralName, using the directoryName [4] choice
+		directoryName, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 4, IsCompound: true, Bytes: cert.RawSubject})
+		if err != nil {
+			return nil, ErrRequestSigningFailed
+		}
+		tbs.RequestorName, err = marshalRawValue(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 1, IsCompound: true, Bytes: directoryName})
+		if err != nil {
+			return nil, ErrRequestSigningFailed
+		}
+	}
+	tbsDER, err := asn1.Marshal(tbs)
+	if err != nil {
+		return nil, ErrRequestSigningFailed
+	}
+
+	signatureAlgorithm, hash, err := requestSignatureAlgorithm(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	digest := tbsDER
+	if hash != 0 {
+		h := hash.New()
+		h.Write(tbsDER)
+		digest = h.Sum(nil)
+	}
+	signature, err := signer.Sign(rand.Reader, digest, hash)
+	if err != nil {
+		return nil, ErrRequestSigningFailed
+	}
+
+	signed := signedRequestASN1{
+		TBSRequest: asn1.RawValue{FullBytes: tbsDER},
+		OptionalSignature: signatureASN1{
+			SignatureAlgorithm: signatureAlgorithm,
+			Signature:          asn1.BitString{Bytes: signature, BitLength: 8 * len(signature)},
+		},
+	}
+	if cert != nil {
+		signed.OptionalSignature.Certs = []asn1.RawValue{{FullBytes: cert.Raw}}
+	}
+
+	signedDER, err := asn1.Marshal(signed)
+	if err != nil {
+		return nil, ErrRequestSigningFailed
+	}
+	return signedDER, nil
+}
+
+// requestSignatureAlgorithm returns the signature algorithm and hash used to sign a request with the public key's private key
+func requestSignatureAlgorithm(publicKey crypto.PublicKey) (pkix.AlgorithmIdentifier, crypto.Hash, error) {
+	switch publicKey.(type) {
+	case *rsa.PublicKey:
+		return pkix.AlgorithmIdentifier{Algorithm: oidSignatureSHA256WithRSA, Parameters: asn1.NullRawValue}, crypto.SHA256, nil
+	case *ecdsa.PublicKey:
+		return pkix.AlgorithmIdentifier{Algorithm: oidSignatureECDSAWithSHA256}, crypto.SHA256, nil
+	case ed25519.PublicKey:
+		return pkix.AlgorithmIdentifier{Algorithm: oidSignatureEd25519}, 0, nil
+	default:
+		return pkix.AlgorithmIdentifier{}, 0, ErrRequestSigningFailed
+	}
+}
+
+// marshalRawValue returns value with FullBytes set to its DER encoding
+func marshalRawValue(value asn1.RawValue) (asn1.RawValue, error) {
+	der, err := asn1.Marshal(value)
+	if err != nil {
+		return asn1.RawValue{}, err
+	}
+	return asn1.RawValue{FullBytes: der}, nil
+}
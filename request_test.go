@@ -0,0 +1,134 @@
+package ocspstapling
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"golang.org/x/crypto/ocsp"
+	"io"
+	"testing"
+)
+
+// unsupportedSigner is a crypto.Signer with a key type requests can't be signed with
+type unsupportedSigner struct{}
+
+func (unsupportedSigner) Public() crypto.PublicKey { return struct{}{} }
+
+func (unsupportedSigner) Sign(io.Reader, []byte, crypto.SignerOpts) ([]byte, error) {
+	return nil, errors.New("unsupported")
+}
+
+func TestSignRequest(t *testing.T) {
+	ca, certificate := newTestCertificate(t)
+	der, err := ocsp.CreateRequest(certificate.Leaf, ca.cert, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, nonce, err := addNonce(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sha256Digest := func(message []byte) []byte {
+		digest := sha256.Sum256(message)
+		return digest[:]
+	}
+
+	tests := []struct {
+		name          string
+		signer        crypto.Signer
+		withCert      bool
+		wantAlgorithm asn1.ObjectIdentifier
+		verify        func(message, signature []byte) bool
+	}{
+		{"RSA", rsaKey, true, oidSignatureSHA256WithRSA, func(message, signature []byte) bool {
+			return rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA256, sha256Digest(message), signature) == nil
+		}},
+		{"ECDSA", ecdsaKey, true, oidSignatureECDSAWithSHA256, func(message, signature []byte) bool {
+			return ecdsa.VerifyASN1(&ecdsaKey.PublicKey, sha256Digest(message), signature)
+		}},
+		{"Ed25519", ed25519Key, true, oidSignatureEd25519, func(message, signature []byte) bool {
+			return ed25519.Verify(ed25519Key.Public().(ed25519.PublicKey), message, signature)
+		}},
+		{"without certificate", ecdsaKey, false, oidSignatureECDSAWithSHA256, func(message, signature []byte) bool {
+			return ecdsa.VerifyASN1(&ecdsaKey.PublicKey, sha256Digest(message), signature)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signerCert := certificate.Leaf
+			if !tt.withCert {
+				signerCert = nil
+			}
+			signed, err := signRequest(der, tt.signer, signerCert)
+			if err != nil {
+				t.Fatalf("signRequest() error = %v", err)
+			}
+
+			var request signedRequestASN1
+			if rest, err := asn1.Unmarshal(signed, &request); err != nil || len(rest) != 0 {
+				t.Fatalf("could not parse signed request: %v", err)
+			}
+			signature := request.OptionalSignature
+			if !signature.SignatureAlgorithm.Algorithm.Equal(tt.wantAlgorithm) {
+				t.Errorf("signature algorithm = %v, want %v", signature.SignatureAlgorithm.Algorithm, tt.wantAlgorithm)
+			}
+			if !tt.verify(request.TBSRequest.FullBytes, signature.Signature.Bytes) {
+				t.Error("signature doesn't verify")
+			}
+
+			// The optional requestorName can't be told apart from the request list when parsing, so the structure depends
+			// on whether it is expected
+			var extensions []pkix.Extension
+			if tt.withCert {
+				var tbs tbsRequestASN1
+				if _, err := asn1.Unmarshal(request.TBSRequest.FullBytes, &tbs); err != nil {
+					t.Fatalf("could not parse TBSRequest: %v", err)
+				}
+				if tbs.RequestorName.Class != asn1.ClassContextSpecific || tbs.RequestorName.Tag != 1 {
+					t.Error("signed request has no requestorName")
+				}
+				if len(signature.Certs) != 1 || !bytes.Equal(signature.Certs[0].FullBytes, signerCert.Raw) {
+					t.Error("signed request doesn't include the signer certificate")
+				}
+				extensions = tbs.RequestExtensions
+			} else {
+				var tbs unsignedTBSRequestASN1
+				if _, err := asn1.Unmarshal(request.TBSRequest.FullBytes, &tbs); err != nil {
+					t.Fatalf("could not parse TBSRequest without requestorName: %v", err)
+				}
+				if len(signature.Certs) != 0 {
+					t.Error("signed request includes a certificate")
+				}
+				extensions = tbs.RequestExtensions
+			}
+			if len(extensions) != 1 || !bytes.Equal(extensions[0].Value, nonce) {
+				t.Error("signed request lost the nonce")
+			}
+		})
+	}
+
+	if _, err := signRequest(der, unsupportedSigner{}, nil); !errors.Is(err, ErrRequestSigningFailed) {
+		t.Errorf("signRequest() with unsupported key error = %v, want ErrRequestSigningFailed", err)
+	}
+}
@@ -0,0 +1,190 @@
+package ocspstapling
+
+import (
+	"fmt"
+	"golang.org/x/crypto/ocsp"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// simulationWindow is the period over which SimulateSchedule reports renewal instants
+const simulationWindow = 30 * 24 * time.Hour
+
+// retryDelay is the delay before a failed fetch is retried by the built-in schedulers
+const retryDelay = time.Minute
+
+// Scheduler decides when the renewal loop fetches the next OCSP response. Set it with WithScheduler.
+// Next is called while the Stapling holds its lock, so it must return quickly and must not call methods of the Stapling,
+// which would deadlock.
+type Scheduler interface {
+	// Next returns the delay after now until the next fetch. After a successful fetch resp is the newly fetched response,
+	// lastErr is nil and attempt is 0. After a failed fetch resp is the currently installed response, or nil when none is
+	// installed, lastErr is the error of the fetch and attempt is the number of consecutive failed fetches.
+	Next(resp *ocsp.Response, lastErr error, attempt int, now time.Time) time.Duration
+}
+
+// Backoff describes the delays between retries, see WithRetryBackoff
+type Backoff struct {
+	// Base is the delay before the first retry
+	Base time.Duration
+	// Max caps the delay, 0 means no cap
+	Max time.Duration
+	// Exponential doubles the delay with every retry, otherwise it grows linearly by Base
+	Exponential bool
+	// Jitter randomizes every delay by up to this fraction in both directions, e.g. 0.1 for +/- 10%
+	Jitter float64
+}
+
+// delay returns the delay before the given retry, starting at 1
+func (b Backoff) delay(attempt int) time.Duration {
+	d := b.Base * time.Duration(attempt)
+	if b.Exponential {
+		d = b.Base
+		// Stop doubling at the cap, or before overflowing
+		for i := 1; i < attempt && d < math.MaxInt64/2 && (b.Max <= 0 || d < b.Max); i++ {
+			d *= 2
+		}
+	}
+	if b.Max > 0 && d > b.Max {
+		d = b.Max
+	}
+	if b.Jitter > 0 {
+		d = time.Duration(float64(d) * (1 - b.Jitter + 2*b.Jitter*rand.Float64()))
+	}
+	return d
+}
+
+// reasoningScheduler is implemented by the built-in schedulers to explain their decisions in the trace log
+type reasoningScheduler interface {
+	// decide returns the delay like Scheduler.Next, and which rule determined it
+	decide(resp *ocsp.Response, lastErr error, attempt int, now time.Time) (time.Duration, string)
+}
+
+// nextUpdateScheduler is the default Scheduler. It renews at NextUpdate and retries failed fetches after a minute.
+type nextUpdateScheduler struct{}
+
+func (n nextUpdateScheduler) Next(resp *ocsp.Response, lastErr error, attempt int, now time.Time) time.Duration {
+	delay, _ := n.decide(resp, lastErr, attempt, now)
+	return delay
+}
+
+func (nextUpdateScheduler) decide(resp *ocsp.Response, lastErr error, _ int, now time.Time) (time.Duration, string) {
+	if lastErr != nil || resp == nil {
+		return retryDelay, "retry delay"
+	}
+	// NextUpdate is the time when the issuer of the certificate will renew the OCSP data
+	return resp.NextUpdate.Sub(now), "NextUpdate"
+}
+
+// cronScheduler renews at the times matching a cron schedule, with NextUpdate as upper bound
+type cronScheduler struct {
+	schedule *cronSchedule
+}
+
+// NewCronScheduler returns a Scheduler that renews at the times matching the standard 5 field cron spec, see WithCronSchedule.
+// Failed fetches are retried after a minute.
+func NewCronScheduler(spec string) (Scheduler, error) {
+	schedule, err := parseCron(spec)
+	if err != nil {
+		return nil, err
+	}
+	return cronScheduler{schedule: schedule}, nil
+}
+
+func (c cronScheduler) Next(resp *ocsp.Response, lastErr error, attempt int, now time.Time) time.Duration {
+	delay, _ := c.decide(resp, lastErr, attempt, now)
+	return delay
+}
+
+func (c cronScheduler) decide(resp *ocsp.Response, lastErr error, attempt int, now time.Time) (time.Duration, string) {
+	delay, reason := nextUpdateScheduler{}.decide(resp, lastErr, attempt, now)
+	if lastErr != nil || resp == nil {
+		return delay, reason
+	}
+	// Renew at the next scheduled time, NextUpdate remains the upper bound
+	if scheduled := c.schedule.next(now); !scheduled.IsZero() && scheduled.Sub(now) < delay {
+		return scheduled.Sub(now), "cron schedule"
+	}
+	return delay, "NextUpdate, before the next cron time"
+}
+
+// fractionScheduler renews once a fraction of the validity period of the response has elapsed
+type fractionScheduler struct {
+	fraction float64
+}
+
+func (f fractionScheduler) Next(resp *ocsp.Response, lastErr error, attempt int, now time.Time) time.Duration {
+	delay, _ := f.decide(resp, lastErr, attempt, now)
+	return delay
+}
+
+func (f fractionScheduler) decide(resp *ocsp.Response, lastErr error, attempt int, now time.Time) (time.Duration, string) {
+	if lastErr != nil || resp == nil {
+		return nextUpdateScheduler{}.decide(resp, lastErr, attempt, now)
+	}
+	validity := resp.NextUpdate.Sub(resp.ThisUpdate)
+	renewAt := resp.ThisUpdate.Add(time.Duration(float64(validity) * f.fraction))
+	if renewAt.Before(now) {
+		// Already due, fetch immediately
+		return 0, fmt.Sprintf("renewal fraction %g already passed", f.fraction)
+	}
+	return renewAt.Sub(now), fmt.Sprintf("renewal fraction %g of the validity period", f.fraction)
+}
+
+// decide asks the scheduler for the delay until the next fetch, and which rule determined it. Retries of the built-in
+// schedulers follow the backoff set with WithRetryBackoff.
+func (cfg *config) decide(resp *ocsp.Response, lastErr error, attempt int, now time.Time) (time.Duration, string) {
+	if scheduler, ok := cfg.scheduler.(reasoningScheduler); ok {
+		if lastErr != nil && cfg.backoff != nil {
+			return cfg.backoff.delay(attempt), fmt.Sprintf("retry backoff for attempt %d", attempt)
+		}
+		return scheduler.decide(resp, lastErr, attempt, now)
+	}
+	return cfg.scheduler.Next(resp, lastErr, attempt, now), fmt.Sprintf("custom scheduler %T", cfg.scheduler)
+}
+
+// renewalDecision returns the time the renewal loop renews the staple of response, that was installed at now, and which
+// rule determined it
+func (cfg *config) renewalDecision(now time.Time, response *ocsp.Response) (time.Time, string) {
+	delay, reason := cfg.decide(response, nil, 0, now)
+	return now.Add(delay), reason
+}
+
+// renewalTime returns the time the renewal loop renews the staple of response, that was installed at now
+func (cfg *config) renewalTime(now time.Time, response *ocsp.Response) time.Time {
+	renewAt, _ := cfg.renewalDecision(now, response)
+	return renewAt
+}
+
+// ComputeRenewalTime returns the time the renewal loop, configured with opts, would fetch a new response after installing a
+// response with the given ThisUpdate and NextUpdate. Invalid options are ignored.
+func ComputeRenewalTime(thisUpdate, nextUpdate time.Time, opts ...Option) time.Time {
+	cfg := newConfig(opts)
+	return cfg.renewalTime(time.Now(), &ocsp.Response{Status: ocsp.Good, ThisUpdate: thisUpdate, NextUpdate: nextUpdate})
+}
+
+// SimulateSchedule returns the renewal instants the renewal loop, configured with opts, would pick during the 30 days after
+// thisUpdate. The simulation assumes every fetch succeeds and that the responder issues each new response at fetch time with
+// the same validity period as the given response. This allows tuning the renewal cadence without running a live loop.
+// Invalid options are ignored.
+func SimulateSchedule(thisUpdate, nextUpdate time.Time, opts ...Option) []time.Time {
+	cfg := newConfig(opts)
+	validity := nextUpdate.Sub(thisUpdate)
+	end := thisUpdate.Add(simulationWindow)
+
+	var schedule []time.Time
+	now := thisUpdate
+	for {
+		renewAt := cfg.renewalTime(now, &ocsp.Response{Status: ocsp.Good, ThisUpdate: thisUpdate, NextUpdate: nextUpdate})
+		if renewAt.After(end) {
+			return schedule
+		}
+		schedule = append(schedule, renewAt)
+		if !renewAt.After(now) {
+			// The schedule doesn't advance, a live loop would keep fetching immediately
+			return schedule
+		}
+		now, thisUpdate, nextUpdate = renewAt, renewAt, renewAt.Add(validity)
+	}
+}
@@ -0,0 +1,31 @@
+package ocspstapling
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+)
+
+// oidSCTList identifies the embedded Signed Certificate Timestamp list extension, see RFC 6962 section 3.3
+var oidSCTList = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+
+// oidCTPoison identifies the poison extension of a precertificate, see RFC 6962 section 3.1
+var oidCTPoison = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 3}
+
+// hasEmbeddedSCTs reports whether the certificate carries a non-empty SCT list. The SCTs themselves aren't verified.
+// A precertificate never qualifies, it must not be served.
+func hasEmbeddedSCTs(certificate *x509.Certificate) bool {
+	found := false
+	for _, extension := range certificate.Extensions {
+		switch {
+		case extension.Id.Equal(oidCTPoison):
+			return false
+		case extension.Id.Equal(oidSCTList):
+			// The value is an OCTET STRING wrapping the TLS encoded list, which starts with a 2 byte length
+			var list []byte
+			if rest, err := asn1.Unmarshal(extension.Value, &list); err == nil && len(rest) == 0 && len(list) > 2 {
+				found = true
+			}
+		}
+	}
+	return found
+}
@@ -0,0 +1,59 @@
+package ocspstapling
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestHasEmbeddedSCTs(t *testing.T) {
+	ca := newTestCA(t, "issuer")
+	// sctList returns the extension holding the TLS encoded list, an OCTET STRING wrapping a 2 byte length and the entries
+	sctList := func(entries ...byte) pkix.Extension {
+		value, err := asn1.Marshal(append([]byte{0, byte(len(entries))}, entries...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pkix.Extension{Id: oidSCTList, Value: value}
+	}
+	poison := pkix.Extension{Id: oidCTPoison, Critical: true, Value: asn1.NullBytes}
+
+	tests := []struct {
+		name       string
+		extensions []pkix.Extension
+		want       bool
+	}{
+		{"without SCTs", nil, false},
+		{"with SCTs", []pkix.Extension{sctList(0, 3, 1, 2, 3)}, true},
+		{"empty list", []pkix.Extension{sctList()}, false},
+		{"malformed list", []pkix.Extension{{Id: oidSCTList, Value: []byte{0x30, 0x00}}}, false},
+		{"precertificate", []pkix.Extension{poison, sctList(0, 3, 1, 2, 3)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			certificate := ca.certificate(t, x509.Certificate{ExtraExtensions: tt.extensions})
+			if got := hasEmbeddedSCTs(certificate.Leaf); got != tt.want {
+				t.Fatalf("hasEmbeddedSCTs() = %v, want %v", got, tt.want)
+			}
+
+			// WithRequireSCT rejects the certificate before contacting the responder
+			var contacted bool
+			responder := ca.transport(t)
+			transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+				contacted = true
+				return responder(r)
+			})
+			_, err := NewStaplingE(context.Background(), certificate, WithTransport(transport), WithRequireSCT(true))
+			if tt.want && err != nil {
+				t.Fatalf("NewStaplingE() error = %v", err)
+			}
+			if !tt.want && (!errors.Is(err, ErrMissingSCT) || contacted) {
+				t.Fatalf("NewStaplingE() error = %v, contacted responder = %v, want ErrMissingSCT without request", err, contacted)
+			}
+		})
+	}
+}
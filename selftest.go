@@ -0,0 +1,51 @@
+package ocspstapling
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+)
+
+// SelfTest verifies that the staple is actually delivered to clients: it completes a TLS handshake between an in-memory
+// server, that serves the certificate through GetCertificate, and an in-memory client requesting OCSP stapling. It returns
+// ErrNoValidStaple when no staple is served, and ErrSelfTestFailed when the handshake fails or the client received another
+// staple than the installed one. The client doesn't verify the chain, only the delivery of the staple is tested.
+func (s *Stapling) SelfTest(ctx context.Context) error {
+	certificate, err := s.Certificate()
+	if err != nil {
+		return err
+	}
+	if len(certificate.OCSPStaple) == 0 {
+		return ErrNoValidStaple
+	}
+
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	server := tls.Server(serverConn, &tls.Config{
+		GetCertificate: s.GetCertificate,
+		// Session tickets are sent after the handshake, nobody would read them from the pipe
+		SessionTicketsDisabled: true,
+	})
+	// crypto/tls clients always request OCSP stapling
+	client := tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true})
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.HandshakeContext(ctx)
+	}()
+	if err := client.HandshakeContext(ctx); err != nil {
+		return fmt.Errorf("%w: %w", ErrSelfTestFailed, err)
+	}
+	if err := <-serverErr; err != nil {
+		return fmt.Errorf("%w: %w", ErrSelfTestFailed, err)
+	}
+
+	if !bytes.Equal(client.ConnectionState().OCSPResponse, certificate.OCSPStaple) {
+		return fmt.Errorf("%w: client received a different OCSP staple than the installed one", ErrSelfTestFailed)
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package ocspstapling
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// OCSPStore persists raw OCSP responses across restarts, keyed by the CacheKey of the certificate. Set it with WithStore.
+type OCSPStore interface {
+	// Load returns the stored response for certKey, or nil when no response is stored
+	Load(certKey string) ([]byte, error)
+	// Save stores resp for certKey, replacing a previously stored response
+	Save(certKey string, resp []byte) error
+}
+
+// FileStore is an OCSPStore that stores every response in a file in a directory
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore returns a FileStore storing the responses in dir. The directory is created when the first response is saved.
+func NewFileStore(dir string) *FileStore {
+	return &FileStore{dir: dir}
+}
+
+// Load reads the response for certKey, it returns nil when no response is stored
+func (f *FileStore) Load(certKey string) ([]byte, error) {
+	resp, err := os.ReadFile(f.path(certKey))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return resp, err
+}
+
+// Save writes the response for certKey. The file is replaced atomically, so a concurrent Load never reads a partial response.
+func (f *FileStore) Save(certKey string, resp []byte) error {
+	if err := os.MkdirAll(f.dir, 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(f.dir, ".ocsp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(resp); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path(certKey))
+}
+
+// path returns the file of the response for certKey. The colon of the key isn't allowed in file names on every platform.
+func (f *FileStore) path(certKey string) string {
+	return filepath.Join(f.dir, strings.ReplaceAll(certKey, ":", "-")+".ocsp")
+}
+
+// loadFromStore installs the stored staple of the certificate when it is still valid, and reports whether it did
+func (s *Stapling) loadFromStore() (loaded bool) {
+	if s.config.store == nil {
+		return false
+	}
+	defer func() {
+		if loaded {
+			s.cacheHits.Add(1)
+		} else {
+			s.cacheMisses.Add(1)
+		}
+	}()
+	key, err := cacheKey(s.certificate, &s.config)
+	if err != nil {
+		return false
+	}
+	raw, err := s.config.store.Load(key)
+	if err != nil {
+		s.config.logger.Warn("ocspstapling: could not load OCSP staple from store", "key", key, "error", err)
+		return false
+	}
+	if raw == nil {
+		return false
+	}
+	if s.config.cacheSigningKey != nil {
+		if raw, err = openStoredStaple(s.config.cacheSigningKey, key, raw); err != nil {
+			s.config.logger.Warn("ocspstapling: rejected OCSP staple from store", "key", key, "error", err)
+			s.lock.Lock()
+			s.errorHistory.add(time.Now(), err)
+			s.lock.Unlock()
+			return false
+		}
+	}
+
+	x509Cert, x509Issuer, err := parseChain(s.certificate, &s.config)
+	if err != nil {
+		return false
+	}
+	response, err := parseResponse(raw, x509Issuer, &s.config)
+	if err == nil && response.SerialNumber.Cmp(x509Cert.SerialNumber) != 0 {
+		err = ErrStapleKeyMismatch
+	}
+	if err == nil {
+		err = checkResponseTime(response, time.Now(), &s.config)
+	}
+	if err != nil {
+		// An outdated or corrupt staple, fetch a new one as usual
+		s.config.logger.Debug("ocspstapling: not using stored OCSP staple", "key", key, "error", err)
+		return false
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.recordStatus(response)
+	s.installStaple(raw, response, SourceCache)
+	return true
+}
+
+// saveToStore saves the current staple to the store, errors are logged
+func (s *Stapling) saveToStore() {
+	if err := s.save(); err != nil {
+		s.config.logger.Warn("ocspstapling: could not save OCSP staple to store", "error", err)
+	}
+}
+
+// save saves the current staple to the store. Saves are serialized and always save the current staple, so an older staple
+// never overwrites a newer one.
+func (s *Stapling) save() error {
+	s.saveLock.Lock()
+	defer s.saveLock.Unlock()
+
+	s.lock.RLock()
+	certificate := s.certificate
+	s.lock.RUnlock()
+	if len(certificate.OCSPStaple) == 0 {
+		return nil
+	}
+
+	key, err := cacheKey(certificate, &s.config)
+	if err != nil {
+		return err
+	}
+	raw := certificate.OCSPStaple
+	if s.config.cacheSigningKey != nil {
+		raw = sealStoredStaple(s.config.cacheSigningKey, key, raw)
+	}
+	return s.config.store.Save(key, raw)
+}
+
+// sealStoredStaple returns raw followed by its signature, an HMAC-SHA256 with signingKey over the cache key and raw
+func sealStoredStaple(signingKey []byte, certKey string, raw []byte) []byte {
+	return append(append([]byte(nil), raw...), storedStapleMAC(signingKey, certKey, raw)...)
+}
+
+// openStoredStaple verifies the signature of a staple sealed with sealStoredStaple and returns the staple. ErrCacheTampered
+// is returned when the signature doesn't match.
+func openStoredStaple(signingKey []byte, certKey string, sealed []byte) ([]byte, error) {
+	if len(sealed) < sha256.Size {
+		return nil, ErrCacheTampered
+	}
+	raw, mac := sealed[:len(sealed)-sha256.Size], sealed[len(sealed)-sha256.Size:]
+	if !hmac.Equal(mac, storedStapleMAC(signingKey, certKey, raw)) {
+		return nil, ErrCacheTampered
+	}
+	return raw, nil
+}
+
+// storedStapleMAC returns the HMAC-SHA256 with signingKey over the cache key and raw. The key is length-prefixed, so the
+// boundary between the key and the staple is unambiguous.
+func storedStapleMAC(signingKey []byte, certKey string, raw []byte) []byte {
+	mac := hmac.New(sha256.New, signingKey)
+	_ = binary.Write(mac, binary.BigEndian, uint32(len(certKey)))
+	mac.Write([]byte(certKey))
+	mac.Write(raw)
+	return mac.Sum(nil)
+}
+
+// CacheStats returns how often the staple was loaded from the store configured with WithStore, and how often the store had
+// no valid staple so it had to be fetched from the responder. The store is consulted when the Stapling is created.
+func (s *Stapling) CacheStats() (hits, misses uint64) {
+	return s.cacheHits.Load(), s.cacheMisses.Load()
+}
+
+// Close stops the renewal loop, see Stop, and saves the current staple to the store configured with WithStore one final
+// time, so a quick restart can load it instead of contacting the responder. The error of saving is returned. Without
+// store, or without valid staple, Close only stops the renewal loop. The Events channel is closed, also when the renewal
+// loop was never started.
+func (s *Stapling) Close() error {
+	s.Stop()
+	s.closeEvents()
+	if s.config.store == nil {
+		return nil
+	}
+
+	s.lock.RLock()
+	valid := s.hasValidStaple()
+	s.lock.RUnlock()
+	if !valid {
+		return nil
+	}
+	return s.save()
+}
+
+// publishStaple pushes the current staple to the staple sink. Like saveToStore, publishes are serialized and always publish
+// the current staple.
+func (s *Stapling) publishStaple() {
+	s.publishLock.Lock()
+	defer s.publishLock.Unlock()
+
+	s.lock.RLock()
+	raw := s.certificate.OCSPStaple
+	nextUpdate := s.nextUpdate
+	s.lock.RUnlock()
+	if len(raw) == 0 {
+		return
+	}
+
+	if err := s.config.stapleSink(context.Background(), raw, nextUpdate); err != nil {
+		s.config.logger.Warn("ocspstapling: could not publish OCSP staple to sink", "error", err)
+	}
+}
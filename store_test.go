@@ -0,0 +1,147 @@
+package ocspstapling
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheSigningKey(t *testing.T) {
+	ca, certificate := newTestCertificate(t)
+	var requests atomic.Int32
+	responder := ca.transport(t)
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		requests.Add(1)
+		return responder(r)
+	})
+	dir := t.TempDir()
+	store := NewFileStore(dir)
+	// start creates a Stapling with the store, and reports whether it used the stored staple
+	start := func(signingKey string) (*Stapling, bool) {
+		t.Helper()
+		requests.Store(0)
+		s, err := NewStaplingE(context.Background(), certificate, WithTransport(transport), WithStore(store),
+			WithCacheSigningKey([]byte(signingKey)))
+		if err != nil {
+			t.Fatalf("NewStaplingE() error = %v", err)
+		}
+		return s, requests.Load() == 0 && s.StapleSource() == SourceCache
+	}
+	tampered := func(s *Stapling) bool {
+		for _, e := range s.RecentErrors() {
+			if errors.Is(e.Err, ErrCacheTampered) {
+				return true
+			}
+		}
+		return false
+	}
+
+	s, _ := start("secret")
+	if err := s.RefreshNow(context.Background()); err != nil {
+		t.Fatalf("RefreshNow() error = %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if _, cached := start("secret"); !cached {
+		t.Fatal("signed staple wasn't loaded from the store")
+	}
+	if s, cached := start("other secret"); cached || !tampered(s) {
+		t.Fatal("staple signed with another key was loaded from the store")
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.ocsp"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("stored files = %v, %v", files, err)
+	}
+	stored, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored[len(stored)/2] ^= 0xff
+	if err := os.WriteFile(files[0], stored, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if s, cached := start("secret"); cached || !tampered(s) {
+		t.Fatal("tampered staple was loaded from the store")
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	ca := newTestCA(t, "issuer")
+	var certificates []tls.Certificate
+	for serial := int64(42); serial < 44; serial++ {
+		certificates = append(certificates, ca.certificate(t, x509.Certificate{SerialNumber: big.NewInt(serial)}))
+	}
+	store := NewFileStore(t.TempDir())
+
+	m := NewManager(WithTransport(ca.transport(t)), WithStore(store))
+	for _, certificate := range certificates {
+		s, err := m.Add(context.Background(), certificate)
+		if err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+		if err := s.RefreshNow(context.Background()); err != nil {
+			t.Fatalf("RefreshNow() error = %v", err)
+		}
+	}
+	if hits, misses := m.CacheStats(); hits != 0 || misses != 2 {
+		t.Fatalf("CacheStats() = %d hits, %d misses, want 0 hits, 2 misses", hits, misses)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	m = NewManager(WithTransport(ca.transport(t)), WithStore(store))
+	defer m.Close()
+	for _, certificate := range certificates {
+		if _, err := m.Add(context.Background(), certificate); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+	if hits, misses := m.CacheStats(); hits != 2 || misses != 0 {
+		t.Fatalf("CacheStats() = %d hits, %d misses, want 2 hits, 0 misses", hits, misses)
+	}
+}
+
+func TestCloseSavesStapleWithoutNextUpdate(t *testing.T) {
+	ca, certificate := newTestCertificate(t)
+	dir := t.TempDir()
+	store := NewFileStore(dir)
+	s, err := NewStaplingE(context.Background(), certificate, WithTransport(ca.transport(t)), WithStore(store))
+	if err != nil {
+		t.Fatalf("NewStaplingE() error = %v", err)
+	}
+	raw := ca.staple(t, 42, time.Now(), time.Time{})
+	if err := s.SetStaple(raw); err != nil {
+		t.Fatalf("SetStaple() error = %v", err)
+	}
+	key, err := CacheKey(certificate)
+	if err != nil {
+		t.Fatalf("CacheKey() error = %v", err)
+	}
+	// Wait for the save of the imported staple, and remove it so only Close can save it again
+	eventually(t, func() bool {
+		stored, _ := store.Load(key)
+		return bytes.Equal(stored, raw)
+	}, "imported staple wasn't saved")
+	if err := os.Remove(store.path(key)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if stored, _ := store.Load(key); !bytes.Equal(stored, raw) {
+		t.Fatal("Close() didn't save the staple without NextUpdate")
+	}
+}
@@ -0,0 +1,23 @@
+package ocspstapling
+
+// Testing exposes hooks to test code that uses a Stapling, e.g. integration tests that need renewals to happen
+// deterministically without waiting for the renewal timer. It is intended for testing only and must not be used in
+// production code.
+type Testing struct {
+	s *Stapling
+}
+
+// Testing returns the testing hooks of the Stapling. It is intended for testing only.
+func (s *Stapling) Testing() Testing {
+	return Testing{s: s}
+}
+
+// FastForward makes the renewal loop act as if its renewal timer fired now: a due fetch is made, or a prefetched response
+// is installed. It doesn't wait for the renewal to complete, use Stapling.Events to observe its outcome. A pending fast
+// forward that the loop hasn't handled yet is sufficient, so calls are coalesced. It is intended for testing only.
+func (t Testing) FastForward() {
+	select {
+	case t.s.fastForward <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,13 @@
+package ocspstapling
+
+import "crypto/tls"
+
+// HTTPSConfig returns a tls.Config for HTTPS servers that serves the stapled certificate, with MinVersion TLS 1.2 and
+// NextProtos "h2" and "http/1.1". A new config is returned on every call, so the defaults can be overridden by modifying it.
+func (s *Stapling) HTTPSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: s.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+}